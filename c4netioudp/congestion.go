@@ -0,0 +1,310 @@
+package c4netioudp
+
+import (
+	"sync"
+	"time"
+)
+
+// A CongestionController decides how fast a Conn sends data fragments. Conns
+// without a controller send all fragments of a message back to back.
+//
+// Check packets only acknowledge complete messages, so a window smaller than
+// a message can't be enforced within the message. Write checks the window
+// before the first fragment of every message and paces all fragments,
+// including retransmissions and unreliable messages.
+//
+// Methods are called with a lock held, implementations don't need their own
+// synchronization.
+type CongestionController interface {
+	// Window returns the maximum number of unacknowledged fragments. Zero
+	// means no limit.
+	Window() int
+	// PacingInterval returns the minimum time between two fragments. Zero
+	// disables pacing.
+	PacingInterval() time.Duration
+	// OnSent is called after sending new fragments.
+	OnSent(fragments int)
+	// OnAck is called when the peer acknowledges fragments. rtt is a
+	// round-trip time sample, or zero if there is none.
+	OnAck(fragments int, rtt time.Duration)
+	// OnLoss is called when retransmitting fragments, either because the
+	// peer asked for them or because the retransmission timer expired.
+	OnLoss(timeout bool)
+}
+
+// congestion connects a CongestionController to a Conn. Write waits in
+// sendFragment, retransmissions and unreliable messages in pace.
+// handlePackets reports acknowledgements and losses.
+type congestion struct {
+	mu       sync.Mutex
+	cc       CongestionController
+	inflight int           // unacknowledged fragments
+	next     time.Time     // earliest time for the next fragment
+	wake     chan struct{} // signals a waiting writer
+}
+
+func newCongestion() *congestion {
+	return &congestion{wake: make(chan struct{}, 1)}
+}
+
+func (g *congestion) signal() {
+	select {
+	case g.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sendFragment waits until the controller allows sending another fragment.
+// The window only applies to the first fragment of a message.
+func (g *congestion) sendFragment(first bool, quit <-chan bool, deadline <-chan struct{}) error {
+	g.mu.Lock()
+	if err := g.wait(first, quit, deadline); err != nil {
+		return err
+	}
+	g.inflight++
+	if g.cc != nil {
+		g.cc.OnSent(1)
+	}
+	g.advance()
+	g.mu.Unlock()
+	return nil
+}
+
+// pace waits like sendFragment, but doesn't count the packet as in flight:
+// Retransmitted fragments already are since their first transmission, and
+// unreliable messages are never acknowledged.
+func (g *congestion) pace(first bool, quit <-chan bool, deadline <-chan struct{}) error {
+	g.mu.Lock()
+	if err := g.wait(first, quit, deadline); err != nil {
+		return err
+	}
+	g.advance()
+	g.mu.Unlock()
+	return nil
+}
+
+// wait blocks until the window and pacing allow sending a fragment. It's
+// called with g.mu held and returns with g.mu held, unless there's an error.
+func (g *congestion) wait(first bool, quit <-chan bool, deadline <-chan struct{}) error {
+	for g.cc != nil {
+		var wait time.Duration
+		if w := g.cc.Window(); first && w > 0 && g.inflight >= w {
+			wait = -1 // until the next acknowledgement
+		} else if d := time.Until(g.next); d > 0 {
+			wait = d
+		} else {
+			break
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		g.mu.Unlock()
+		var err error
+		select {
+		case <-g.wake:
+		case <-timeout:
+		case <-deadline:
+			err = timeoutError{}
+		case <-quit:
+			err = errQuit
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
+		}
+		g.mu.Lock()
+	}
+	return nil
+}
+
+// advance moves the pacing schedule past a fragment sent now.
+func (g *congestion) advance() {
+	if g.cc == nil {
+		return
+	}
+	now := time.Now()
+	if g.next.Before(now) {
+		g.next = now
+	}
+	g.next = g.next.Add(g.cc.PacingInterval())
+}
+
+func (g *congestion) ack(fragments int, rtt time.Duration) {
+	g.mu.Lock()
+	g.inflight -= fragments
+	if g.inflight < 0 {
+		g.inflight = 0
+	}
+	if g.cc != nil {
+		g.cc.OnAck(fragments, rtt)
+	}
+	g.mu.Unlock()
+	g.signal()
+}
+
+func (g *congestion) loss(timeout bool) {
+	g.mu.Lock()
+	if g.cc != nil {
+		g.cc.OnLoss(timeout)
+	}
+	g.mu.Unlock()
+}
+
+// SetCongestionController sets the controller limiting how fast Write sends
+// fragments. nil disables congestion control.
+func (c *Conn) SetCongestionController(cc CongestionController) {
+	c.congestion.mu.Lock()
+	c.congestion.cc = cc
+	c.congestion.mu.Unlock()
+	c.congestion.signal()
+}
+
+// Initial window of RenoController in fragments
+const initialCongestionWindow = 10
+
+// RenoController is a window-based controller in the style of TCP NewReno (RFC
+// 6582): The window grows exponentially in slow start and by one fragment per
+// round trip afterwards. Losses halve the window, at most once per window of
+// data. Retransmission timeouts reset it to one fragment. Fragments are paced
+// to spread a window over a round trip.
+type RenoController struct {
+	cwnd     float64
+	ssthresh float64
+	inflight int
+	recovery int           // fragments to be acknowledged before leaving loss recovery
+	srtt     time.Duration // smoothed round-trip time for pacing
+}
+
+func NewRenoController() *RenoController {
+	return &RenoController{cwnd: initialCongestionWindow, ssthresh: 1 << 30}
+}
+
+func (r *RenoController) Window() int {
+	return int(r.cwnd)
+}
+
+func (r *RenoController) PacingInterval() time.Duration {
+	return r.srtt / time.Duration(r.cwnd)
+}
+
+func (r *RenoController) OnSent(fragments int) {
+	r.inflight += fragments
+}
+
+func (r *RenoController) OnAck(fragments int, rtt time.Duration) {
+	if rtt > 0 {
+		if r.srtt == 0 {
+			r.srtt = rtt
+		} else {
+			r.srtt = (7*r.srtt + rtt) / 8
+		}
+	}
+	r.inflight -= fragments
+	if r.inflight < 0 {
+		r.inflight = 0
+	}
+	if r.recovery > 0 {
+		r.recovery -= fragments
+		return
+	}
+	if r.cwnd < r.ssthresh {
+		r.cwnd += float64(fragments)
+	} else {
+		r.cwnd += float64(fragments) / r.cwnd
+	}
+}
+
+func (r *RenoController) OnLoss(timeout bool) {
+	if r.recovery > 0 && !timeout {
+		// Still recovering from an earlier loss.
+		return
+	}
+	r.ssthresh = r.cwnd / 2
+	if r.ssthresh < 2 {
+		r.ssthresh = 2
+	}
+	if timeout {
+		r.cwnd = 1
+	} else {
+		r.cwnd = r.ssthresh
+	}
+	r.recovery = r.inflight
+}
+
+// Bounds for the sending rate of DelayPacer in fragments per second
+const (
+	minPacingRate = 10
+	maxPacingRate = 100000
+)
+
+// DelayPacer sends fragments at a steady rate which it adapts to the
+// round-trip time: While the RTT stays close to the lowest RTT seen, the rate
+// increases. Growing RTTs mean that queues build up along the path, so the
+// rate decreases, as it does on loss.
+type DelayPacer struct {
+	rate     float64       // fragments per second
+	minRTT   time.Duration // lowest RTT sample
+	lastLoss time.Time     // time of the last decrease because of loss
+}
+
+// NewDelayPacer creates a pacer starting at the given rate in fragments per
+// second.
+func NewDelayPacer(rate float64) *DelayPacer {
+	p := &DelayPacer{rate: rate}
+	p.clamp()
+	return p
+}
+
+func (p *DelayPacer) clamp() {
+	if p.rate < minPacingRate {
+		p.rate = minPacingRate
+	}
+	if p.rate > maxPacingRate {
+		p.rate = maxPacingRate
+	}
+}
+
+func (p *DelayPacer) Window() int { return 0 }
+
+func (p *DelayPacer) PacingInterval() time.Duration {
+	return time.Duration(float64(time.Second) / p.rate)
+}
+
+func (p *DelayPacer) OnSent(fragments int) {}
+
+func (p *DelayPacer) OnAck(fragments int, rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	if p.minRTT == 0 || rtt < p.minRTT {
+		p.minRTT = rtt
+	}
+	// Allow some jitter before assuming queueing delay.
+	if rtt <= p.minRTT+p.minRTT/4+time.Millisecond {
+		p.rate *= 1.1
+	} else {
+		p.rate *= 0.9
+	}
+	p.clamp()
+}
+
+func (p *DelayPacer) OnLoss(timeout bool) {
+	// Only react once per round trip, the peer usually asks for lost
+	// fragments in several Check packets.
+	now := time.Now()
+	rtt := p.minRTT
+	if rtt < minRTO {
+		rtt = minRTO
+	}
+	if !timeout && now.Sub(p.lastLoss) < rtt {
+		return
+	}
+	p.lastLoss = now
+	p.rate *= 0.7
+	p.clamp()
+}
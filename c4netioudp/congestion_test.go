@@ -0,0 +1,142 @@
+package c4netioudp
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRenoController(t *testing.T) {
+	r := NewRenoController()
+	if w := r.Window(); w != initialCongestionWindow {
+		t.Fatalf("initial window %d", w)
+	}
+	// Slow start doubles the window every round trip.
+	r.OnSent(10)
+	r.OnAck(10, 50*time.Millisecond)
+	if w := r.Window(); w != 20 {
+		t.Errorf("window after slow start round: %d, expected 20", w)
+	}
+	// Losses halve the window once per window of data.
+	r.OnSent(20)
+	r.OnLoss(false)
+	r.OnLoss(false)
+	if w := r.Window(); w != 10 {
+		t.Errorf("window after loss: %d, expected 10", w)
+	}
+	r.OnAck(20, 0)
+	// Congestion avoidance grows by one fragment per window.
+	r.OnSent(10)
+	r.OnAck(10, 0)
+	if w := r.Window(); w != 11 {
+		t.Errorf("window in congestion avoidance: %d, expected 11", w)
+	}
+	r.OnLoss(true)
+	if w := r.Window(); w != 1 {
+		t.Errorf("window after timeout: %d, expected 1", w)
+	}
+}
+
+func TestDelayPacer(t *testing.T) {
+	p := NewDelayPacer(100)
+	if d := p.PacingInterval(); d != 10*time.Millisecond {
+		t.Errorf("interval %v at 100 fragments/s", d)
+	}
+	p.OnAck(1, 20*time.Millisecond)
+	p.OnAck(1, 20*time.Millisecond)
+	if p.rate <= 100 {
+		t.Errorf("rate %v didn't increase at minimum RTT", p.rate)
+	}
+	rate := p.rate
+	p.OnAck(1, 100*time.Millisecond)
+	if p.rate >= rate {
+		t.Errorf("rate %v didn't decrease with queueing delay", p.rate)
+	}
+	for i := 0; i < 100; i++ {
+		p.OnLoss(true)
+	}
+	if p.rate != minPacingRate {
+		t.Errorf("rate %v below minimum", p.rate)
+	}
+}
+
+// randomLoss loses packets with the given probability.
+func randomLoss(seed int64, p float64) func([]byte) bool {
+	rng := rand.New(rand.NewSource(seed))
+	return func([]byte) bool {
+		return rng.Float64() < p
+	}
+}
+
+// Bulk transfers complete over a lossy link with all controllers.
+func TestCongestionLossyLink(t *testing.T) {
+	controllers := []struct {
+		name string
+		cc   func() CongestionController
+	}{
+		{"none", func() CongestionController { return nil }},
+		{"Reno", func() CongestionController { return NewRenoController() }},
+		{"DelayPacer", func() CongestionController { return NewDelayPacer(2000) }},
+	}
+	msg := make([]byte, 32*1024)
+	rand.New(rand.NewSource(1)).Read(msg)
+	for _, tt := range controllers {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := pipeConns(t, randomLoss(1, 0.05), randomLoss(2, 0.05))
+			if cc := tt.cc(); cc != nil {
+				a.SetCongestionController(cc)
+			}
+			for i := 0; i < 3; i++ {
+				if _, err := a.Write(msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 3; i++ {
+				if got := readTimeout(t, b, 10*time.Second); !bytes.Equal(got, msg) {
+					t.Fatalf("message %d corrupted", i)
+				}
+			}
+		})
+	}
+}
+
+// fixedWindow is a controller with a constant window.
+type fixedWindow int
+
+func (w fixedWindow) Window() int                            { return int(w) }
+func (w fixedWindow) PacingInterval() time.Duration          { return 0 }
+func (w fixedWindow) OnSent(fragments int)                   {}
+func (w fixedWindow) OnAck(fragments int, rtt time.Duration) {}
+func (w fixedWindow) OnLoss(timeout bool)                    {}
+
+// Write doesn't start messages while the controller's window is full.
+func TestCongestionWindow(t *testing.T) {
+	var mu sync.Mutex
+	sent := make(map[uint32]bool)
+	countData := func(b []byte) bool {
+		if hdr, _ := ReadPacketHdr(b); hdr.StatusByte&0x7f == IPID_Data {
+			mu.Lock()
+			sent[hdr.Nr] = true
+			mu.Unlock()
+		}
+		return false
+	}
+	a, _ := pipeConns(t, countData, dropAll)
+	a.SetCongestionController(fixedWindow(3))
+
+	go func() {
+		for i := 0; i < 10; i++ {
+			a.Write([]byte("hello"))
+		}
+		// Messages larger than the window are sent completely.
+		a.Write(make([]byte, 10*MaxDataSize))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 3 {
+		t.Errorf("sent %d fragments, expected 3", len(sent))
+	}
+}
@@ -3,6 +3,7 @@ package c4netioudp
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -21,55 +22,83 @@ type ErrConnectionClosed string
 func (reason ErrConnectionClosed) Error() string { return string(reason) }
 
 type Conn struct {
-	udp            *net.UDPConn
-	writer         io.Writer       // write packets to me!
-	raddr          *net.UDPAddr    // address we connect to
-	laddr          *net.UDPAddr    // local address as seen by server
-	rfuchan        chan rfu        // channel for receiving raw packets
-	datachan       chan []byte     // channel for complete packages
-	errchan        chan error      // channel for read errors
-	sendchan       chan sendPacket // channel for outgoing packets
-	closechan      chan *Conn      // channel to signal closing to Listener
-	closemutex     sync.Mutex      // mutex protecting Close()
-	quit           chan bool       // closed to signal goroutines
-	closereason    string          // reason the connection was closed
-	noclosepacket  bool            // whether to send a packet on Close()
-	oPacketCounter uint32          // FNr of last outgoing packet
+	udp            PacketConn
+	writer         io.Writer        // write packets to me!
+	raddr          *net.UDPAddr     // address we connect to
+	laddr          *net.UDPAddr     // local address as seen by server
+	rfuchan        chan rfu         // channel for receiving raw packets
+	datachan       chan []byte      // channel for complete packages
+	unreliablechan chan []byte      // channel for unreliable messages
+	errchan        chan error       // channel for read errors
+	sendchan       chan *sendPacket // channel for outgoing packets
+	rtxchan        chan rtxFragment // channel for fragments to retransmit
+	closechan      chan *Conn       // channel to signal closing to Listener
+	closemutex     sync.Mutex       // mutex protecting Close()
+	quit           chan bool        // closed to signal goroutines
+	closereason    string           // reason the connection was closed
+	noclosepacket  bool             // whether to send a packet on Close()
+	oPacketCounter uint32           // FNr of last outgoing packet
+	oPacketsSent   uint32           // Nr after the last fragment actually sent
+	initialINr     uint32           // Nr of the first incoming packet, from the peer's ConnPacket
+	initialONr     uint32           // Nr of the first outgoing packet
+	uPacketCounter uint32           // sequence number of the last unreliable message
+	uPeer          int32            // set atomically when the peer announced support for unreliable messages
+	window         *sendWindow      // limits unacknowledged data
+	congestion     *congestion      // paces fragments
+	writemu        sync.Mutex       // keeps fragments of concurrent writes in order
+	rdeadline      deadline         // deadline for Read
+	wdeadline      deadline         // deadline for Write
+
+	// Called for dropped packets, see ListenConfig.InvalidPacket
+	invalidPacket func(addr *net.UDPAddr, err error)
 }
 
 func newConn() *Conn {
 	return &Conn{
-		rfuchan:  make(chan rfu, 64),
-		datachan: make(chan []byte, 32),
-		errchan:  make(chan error),
-		sendchan: make(chan sendPacket, 64), // should never block
-		quit:     make(chan bool),
+		rfuchan:        make(chan rfu, 64),
+		datachan:       make(chan []byte, 32),
+		unreliablechan: make(chan []byte, 32),
+		errchan:        make(chan error),
+		sendchan:       make(chan *sendPacket, 64),
+		rtxchan:        make(chan rtxFragment, 64),
+		window:         newSendWindow(),
+		congestion:     newCongestion(),
+		quit:           make(chan bool),
+		rdeadline:      makeDeadline(),
+		wdeadline:      makeDeadline(),
 	}
 }
 
 func Dial(network string, laddr, raddr *net.UDPAddr) (*Conn, error) {
+	return DialContext(context.Background(), network, laddr, raddr)
+}
+
+// DialContext connects to raddr like Dial. The handshake is aborted when ctx
+// is done. Without a deadline on ctx, it times out after connTimeout.
+func DialContext(ctx context.Context, network string, laddr, raddr *net.UDPAddr) (*Conn, error) {
 	c := newConn()
 	c.raddr = raddr
-	var err error
-	c.udp, err = net.DialUDP(network, laddr, raddr)
+	udp, err := net.DialUDP(network, laddr, raddr)
 	if err != nil {
 		return nil, err
 	}
-	c.writer = c.udp
+	c.udp = udp
+	c.writer = udp
 	go readFromUDP(c.udp, c.rfuchan, c.quit)
-	if err = c.connect(); err != nil {
-		c.quit <- true
-		return nil, fmt.Errorf("c4netioudp: error while connecting: %v", err)
+	if err = c.connect(ctx); err != nil {
+		close(c.quit)
+		c.udp.Close()
+		return nil, fmt.Errorf("c4netioudp: error while connecting: %w", err)
 	}
 	go c.handlePackets()
 	return c, nil
 }
 
-// punch sends packets over the connection until we receive something or the
-// timeout is reached.
-func (c *Conn) punch(timeout, interval time.Duration) error {
-	timeouttimer := time.NewTimer(timeout)
+// punch sends packets over the connection until we receive something or ctx
+// is done.
+func (c *Conn) punch(ctx context.Context, interval time.Duration) error {
 	intervaltimer := time.NewTimer(interval)
+	defer intervaltimer.Stop()
 	sendMsg := func() {
 		err := c.SendPing(c.raddr)
 		if err != nil {
@@ -85,9 +114,9 @@ func (c *Conn) punch(timeout, interval time.Duration) error {
 			log.WithField("raddr", c.raddr.String()).Debug("punch: sending")
 			sendMsg()
 			intervaltimer.Reset(interval)
-		case <-timeouttimer.C:
+		case <-ctx.Done():
 			log.WithField("raddr", c.raddr.String()).Debug("punch: timeout")
-			return fmt.Errorf("timeout")
+			return ctx.Err()
 		case r := <-c.rfuchan:
 			if r.err != nil {
 				return r.err
@@ -102,8 +131,15 @@ func (c *Conn) punch(timeout, interval time.Duration) error {
 
 }
 
-// connect establishes a connection to another server.
-func (c *Conn) connect() error {
+// connect establishes a connection to another server. It gives up when ctx is
+// done or after connTimeout if ctx has no deadline.
+func (c *Conn) connect(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, connTimeout)
+		defer cancel()
+	}
+
 	// Three-way handshake
 	// 1. ConnPacket --->
 	sendConnPacket := func() error {
@@ -119,12 +155,12 @@ func (c *Conn) connect() error {
 	// 2. <--- ConnPacket
 	// TODO: retries?
 	var recvaddr *net.UDPAddr
-	timeout := time.NewTimer(connTimeout)
 	retrTimer := time.NewTimer(connRetransmissionTimeout)
+	defer retrTimer.Stop()
 	for recvaddr == nil {
 		select {
-		case <-timeout.C:
-			return fmt.Errorf("connection timeout")
+		case <-ctx.Done():
+			return ctx.Err()
 		case <-retrTimer.C:
 			// Retransmit the initial packet in case it went missing.
 			if err := sendConnPacket(); err != nil {
@@ -134,15 +170,16 @@ func (c *Conn) connect() error {
 			if r.err != nil {
 				return r.err
 			}
-			if r.n < ConnPacketSize {
-				log.WithFields(log.Fields{
-					"raddr": c.raddr.String(),
-					"size":  r.n,
-				}).Debug("connect: discarding too-small packet")
-				//return fmt.Errorf("ConnPacket not large enough")
+			b := r.buf[:r.n]
+			hdr, err := ReadPacketHdr(b)
+			if err != nil {
+				c.reportInvalid(err)
 				continue
 			}
-			hdr := ReadPacketHdr(r.buf)
+			if hdr.StatusByte&0x7f == IPID_Close {
+				// The listener refused the connection.
+				return fmt.Errorf("connection refused")
+			}
 			if hdr.StatusByte != IPID_Conn {
 				log.WithFields(log.Fields{
 					"raddr": c.raddr.String(),
@@ -151,12 +188,19 @@ func (c *Conn) connect() error {
 				//return fmt.Errorf("received unexpected packet type %d", hdr.StatusByte)
 				continue
 			}
-			connrepkg := ReadConnPacket(r.buf)
+			connrepkg, err := ReadConnPacket(b)
+			if err != nil {
+				log.WithError(err).WithField("raddr", c.raddr.String()).Debug("connect: discarding invalid packet")
+				c.reportInvalid(err)
+				continue
+			}
 			if connrepkg.ProtocolVer != ProtocolVer {
 				return fmt.Errorf("unsupported protocol version %d", connrepkg.ProtocolVer)
 			}
 			log.WithField("raddr", c.raddr.String()).Debug("connect: <- ConnRePacket")
 			c.laddr = &connrepkg.Addr
+			// Listeners in cookie mode don't start at zero.
+			c.initialINr = connrepkg.Nr
 			recvaddr = r.addr
 		}
 	}
@@ -169,27 +213,22 @@ func (c *Conn) connect() error {
 	if err != nil {
 		return err
 	}
+	// Acknowledge the listener's packet number right away. Listeners in
+	// cookie mode only accept the connection after receiving this.
+	check := NewCheckPacketHdr(nil, c.initialINr, c.oPacketsSent)
+	if _, err := check.WriteTo(c.writer); err != nil {
+		return err
+	}
 
 	// Done, we're connected now and can send/receive data
 	return nil
 }
 
-type recvPacket struct {
-	fragments    map[uint32][]byte
-	size         uint32 // combined size of fragments
-	completeSize uint32
-}
-
-func (p *recvPacket) assemble(fnr uint32) []byte {
-	buf := make([]byte, 0, p.size)
-	for nr := fnr; uint32(len(buf)) < p.size; nr++ {
-		fragment, ok := p.fragments[nr]
-		if !ok {
-			panic("tried to assemble incomplete packet")
-		}
-		buf = append(buf, fragment...)
+// reportInvalid passes errors about dropped packets to the hook.
+func (c *Conn) reportInvalid(err error) {
+	if c.invalidPacket != nil {
+		c.invalidPacket(c.raddr, err)
 	}
-	return buf
 }
 
 // Interval Check packets are sent in
@@ -203,119 +242,254 @@ const connectionTimeout = 30 * time.Second
 // Maximum number of asks per Check packet
 const maxAsks = 10
 
+// stopTimer stops t and drains its channel so that it can be reset.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
 func (c *Conn) handlePackets() {
+	go c.retransmitFragments()
 	timeout := time.NewTimer(connectionTimeout)
 	ticker := time.NewTicker(checkInterval)
-	dpackets := make(map[uint32]*recvPacket)
+	// Retransmission timer, running while there are unacknowledged packets
+	rtx := time.NewTimer(initialRTO)
+	stopTimer(rtx)
+	rtxRunning := false
+	rtt := newRTTEstimator()
+	// Delayed acknowledgement for received data
+	acktimer := time.NewTimer(ackDelay)
+	stopTimer(acktimer)
+	ackPending := false
+	reasm := newReassembler(c.initialINr)
 	sendPackets := list.New()
-	var IPacketCounter uint32  // FNr of next incoming packet
-	var RIPacketCounter uint32 // from incoming Check packet
+	RIPacketCounter := c.initialINr // from incoming Data and Check packets
+	lastAckNr := c.initialONr       // AckNr of the last Check packet
+	var lastUSeq uint32             // sequence number of the newest unreliable message
+	helloAcked := false             // the peer received our unreliable announcement
+	hellosSent := 0
+	restartRtx := func() {
+		stopTimer(rtx)
+		rtxRunning = sendPackets.Len() > 0
+		if rtxRunning {
+			rtx.Reset(rtt.rto)
+		}
+	}
+	scheduleAck := func() {
+		if !ackPending {
+			ackPending = true
+			acktimer.Reset(ackDelay)
+		}
+	}
+	sendCheck := func() {
+		asks := reasm.missing(RIPacketCounter, maxAsks)
+		check := NewCheckPacketHdr(asks, reasm.next, atomic.LoadUint32(&c.oPacketsSent))
+		_, _ = check.WriteTo(c.writer)
+	}
+	sendHello := func() {
+		hello := newUnreliableHello(atomic.LoadInt32(&c.uPeer) != 0)
+		_, _ = hello.WriteTo(c.writer)
+		hellosSent++
+	}
+	sendHello()
+	retransmit := func(p *sendPacket, i int) {
+		p.retransmitted = true
+		select {
+		case c.rtxchan <- rtxFragment{p, i}:
+		default:
+			// Too many retransmissions queued, the peer will ask again.
+		}
+	}
 	for {
 		select {
 		case <-c.quit:
 			ticker.Stop()
+			rtx.Stop()
+			acktimer.Stop()
 			return
 		case <-ticker.C:
 			// Time for a Check packet!
-			ask := make(map[uint32]bool) // poor gopher's set
-			// First, assume everything missing.
-			for i := IPacketCounter; i < RIPacketCounter; i++ {
-				ask[i] = true
+			sendCheck()
+			if !helloAcked && hellosSent < maxUnreliableHellos {
+				sendHello()
 			}
-			// Now remove those packets we already received.
-			for i := range dpackets {
-				for nr := range dpackets[i].fragments {
-					delete(ask, nr)
+		case <-acktimer.C:
+			ackPending = false
+			sendCheck()
+		case <-rtx.C:
+			// The oldest packet wasn't acknowledged in time, send its first
+			// missing fragment again and back off (RFC 6298, 5.4 - 5.6).
+			// Our Check packet tells the peer how far we sent, so it asks
+			// for any other missing fragments.
+			rtxRunning = false
+			if e := sendPackets.Front(); e != nil {
+				p := e.Value.(*sendPacket)
+				i := p.received
+				if i == len(p.fragments) {
+					// The peer has all fragments, so its acknowledgement
+					// got lost. Any fragment makes it send another one.
+					i = 0
 				}
+				retransmit(p, i)
+				sendCheck()
+				c.congestion.loss(true)
+				rtt.backoff()
+				restartRtx()
 			}
-			// Gather everything into a slice.
-			asks := make([]uint32, 0, maxAsks)
-			for nr := range ask {
-				asks = append(asks, nr)
-				if len(asks) == maxAsks {
-					break
-				}
-			}
-			check := NewCheckPacketHdr(asks, IPacketCounter, c.oPacketCounter)
-			_, _ = check.WriteTo(c.writer)
 		case <-timeout.C:
 			// Peer seems to be down, close connection.
-			c.closereason = "connection timeout"
-			c.Close()
+			c.closeWithReason("connection timeout", true)
 		case r := <-c.rfuchan:
 			if r.err != nil {
 				c.errchan <- r.err
 				continue
 			}
-			if r.n < PacketHdrSize {
+			b := r.buf[:r.n]
+			hdr, err := ReadPacketHdr(b)
+			if err != nil {
+				c.reportInvalid(err)
 				continue
 			}
-			hdr := ReadPacketHdr(r.buf)
-			if hdr.Nr > RIPacketCounter {
-				RIPacketCounter = hdr.Nr
-			}
 			switch hdr.StatusByte & 0x7f {
 			case IPID_Ping:
 				// Reply to ping, ignore errors.
 				//ping := PacketHdr{StatusByte: IPID_Ping}
 				//_, _ = ping.WriteTo(c.writer)
 			case IPID_Data:
-				if r.n < DataPacketHdrSize {
+				data, err := ReadDataPacketHdr(b)
+				if err != nil {
+					c.reportInvalid(err)
 					continue
 				}
-				data := ReadDataPacketHdr(r.buf)
-				if hdr.Nr < IPacketCounter {
-					continue // duplicate packet
+				// Acknowledge soon so that the peer doesn't have to wait
+				// for its retransmission timeout.
+				scheduleAck()
+				RIPacketCounter = seqMax(RIPacketCounter, hdr.Nr)
+				if err := reasm.add(hdr.Nr, data.FNr, data.Size, b[DataPacketHdrSize:]); err != nil {
+					// Malformed fragments are dropped.
+					c.reportInvalid(err)
 				}
-				datasize := uint32(r.n - DataPacketHdrSize)
-				pkt := dpackets[data.FNr]
-				if pkt == nil {
-					pkt = &recvPacket{
-						fragments:    make(map[uint32][]byte),
-						completeSize: data.Size,
+				// Deliver complete messages.
+				for {
+					msg, ok := reasm.pop()
+					if !ok {
+						break
 					}
-					dpackets[data.FNr] = pkt
+					c.datachan <- msg
 				}
-				pkt.fragments[hdr.Nr] = r.buf[DataPacketHdrSize:r.n]
-				pkt.size += datasize
-				// Assemble complete packets.
-				if IPacketCounter == data.FNr {
-					for {
-						pkt, ok := dpackets[IPacketCounter]
-						if ok && pkt.size >= pkt.completeSize {
-							delete(dpackets, IPacketCounter)
-							c.datachan <- pkt.assemble(IPacketCounter)
-							IPacketCounter += uint32(len(pkt.fragments))
-						} else {
-							break
-						}
+			case IPID_Test:
+				if r.n < UnreliablePacketHdrSize {
+					continue // plain test packet
+				}
+				u, err := ReadUnreliablePacketHdr(b)
+				if err != nil {
+					c.reportInvalid(err)
+					continue
+				}
+				if u.Seq == 0 {
+					hello, ok := readUnreliableHello(b)
+					if !ok {
+						continue // test packet of an OpenClonk peer
 					}
+					atomic.StoreInt32(&c.uPeer, 1)
+					if hello.seen {
+						helloAcked = true
+					} else {
+						sendHello()
+					}
+					continue
+				}
+				if atomic.LoadInt32(&c.uPeer) == 0 {
+					// OpenClonk peers use test packets for other things.
+					continue
+				}
+				seq := u.Seq
+				if seqLessEq(seq, lastUSeq) {
+					continue // late or duplicate message
+				}
+				lastUSeq = seq
+				select {
+				case c.unreliablechan <- b[UnreliablePacketHdrSize:]:
+				default:
+					// Nobody is reading, drop the message.
 				}
 			case IPID_Check:
-				if r.n < CheckPacketHdrSize {
+				check, err := ReadCheckPacketHdr(b)
+				if err != nil {
+					c.reportInvalid(err)
 					continue
 				}
-				check := ReadCheckPacketHdr(r.buf)
-				// Remove all ACKed packets.
+				// The peer can't acknowledge packets we didn't send yet.
+				if sent := atomic.LoadUint32(&c.oPacketsSent); seqLess(sent, check.AckNr) {
+					c.reportInvalid(ErrInvalidPacket(fmt.Sprintf("CheckPacketHdr acknowledging %d with only %d sent", check.AckNr, sent)))
+					continue
+				}
+				// Check packets carry the number of the peer's next
+				// packet. Ping, Test and Close packets are always zero,
+				// so they don't count.
+				RIPacketCounter = seqMax(RIPacketCounter, hdr.Nr)
+				// Remove all ACKed packets, measuring the round-trip time
+				// of the newest one that wasn't retransmitted.
+				now := time.Now()
+				var sample time.Duration
+				acked := false
+				var ackedBytes, ackedPackets int
 				var next *list.Element
 				for e := sendPackets.Front(); e != nil; e = next {
 					next = e.Next()
-					p := e.Value.(sendPacket)
-					if p.fnr+uint32(len(p.fragments))-1 < check.AckNr {
+					p := e.Value.(*sendPacket)
+					if seqLess(p.fnr+uint32(len(p.fragments))-1, check.AckNr) {
+						if !p.retransmitted {
+							sample = now.Sub(p.sent)
+						}
 						sendPackets.Remove(e)
+						acked = true
+						ackedBytes += int(p.size)
+						ackedPackets += len(p.fragments)
 					}
 				}
+				if acked {
+					// Let blocked writers continue.
+					c.window.release(ackedBytes, ackedPackets)
+				}
+				if sample > 0 {
+					rtt.sample(sample)
+				}
+				if seqLess(lastAckNr, check.AckNr) {
+					c.congestion.ack(int(check.AckNr-lastAckNr), sample)
+					lastAckNr = check.AckNr
+				}
+				if acked {
+					restartRtx()
+				}
 				// Handle retransmission of packets in Ask.
 				if len(check.Ask) > 0 {
+					c.congestion.loss(false)
 					asks := uint32Slice(check.Ask)
 					sort.Sort(asks)
+					// The peer asks for missing fragments in order, so it
+					// has everything before the first one.
+					for e := sendPackets.Front(); e != nil && seqLess(e.Value.(*sendPacket).fnr, asks[0]); e = e.Next() {
+						p := e.Value.(*sendPacket)
+						n := int(asks[0] - p.fnr)
+						if n > len(p.fragments) {
+							n = len(p.fragments)
+						}
+						if n > p.received {
+							p.received = n
+						}
+					}
 					i := 0
 					e := sendPackets.Front()
 					for e != nil && i < len(asks) {
 						ask := check.Ask[i]
-						p := e.Value.(sendPacket)
-						if ask >= p.fnr && ask < p.fnr+uint32(len(p.fragments)) {
-							c.writeFragment(p.fragments[ask-p.fnr], ask, p.fnr, p.size)
+						p := e.Value.(*sendPacket)
+						if seqInRange(ask, p.fnr, len(p.fragments)) {
+							retransmit(p, int(ask-p.fnr))
 							i++
 						} else {
 							e = e.Next()
@@ -324,9 +498,7 @@ func (c *Conn) handlePackets() {
 				}
 			case IPID_Close:
 				// TODO: Decode packet and check Addr
-				c.closereason = "connection closed by peer"
-				c.noclosepacket = true
-				c.Close()
+				c.closeWithReason("connection closed by peer", false)
 			default:
 				continue
 			}
@@ -343,7 +515,7 @@ func (c *Conn) handlePackets() {
 			// the channel).
 			haveInserted := false
 			for e := sendPackets.Back(); e != nil; e = e.Prev() {
-				if e.Value.(sendPacket).fnr < pkt.fnr {
+				if seqLess(e.Value.(*sendPacket).fnr, pkt.fnr) {
 					sendPackets.InsertAfter(pkt, e)
 					haveInserted = true
 					break
@@ -352,26 +524,75 @@ func (c *Conn) handlePackets() {
 			if !haveInserted {
 				sendPackets.PushFront(pkt)
 			}
+			if !rtxRunning {
+				restartRtx()
+			}
 		}
 	}
 }
 
-// Reads a full message from c.
+// Read reads a full message from c. If b is too small for the message, Read
+// fills b, discards the rest of the message and returns io.ErrShortBuffer.
+// Use ReadMessage to receive messages of any size.
 func (c *Conn) Read(b []byte) (n int, err error) {
+	data, err := c.ReadMessage()
+	if err != nil {
+		return 0, err
+	}
+	n = copy(b, data)
+	if n < len(data) {
+		return n, io.ErrShortBuffer
+	}
+	return n, nil
+}
+
+// ReadMessage returns the next full message from c.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	deadline := c.rdeadline.wait()
+	if isClosed(deadline) {
+		return nil, timeoutError{}
+	}
 	select {
 	case data := <-c.datachan:
-		copy(b, data)
-		return len(data), nil
-	case err = <-c.errchan:
-		return
+		return data, nil
+	case err := <-c.errchan:
+		return nil, err
 	case <-c.quit:
-		return 0, ErrConnectionClosed(c.closereason)
+		return nil, ErrConnectionClosed(c.closereason)
+	case <-deadline:
+		return nil, timeoutError{}
 	}
 }
 
 type sendPacket struct {
-	fragments [][]byte
-	fnr, size uint32
+	fragments     [][]byte
+	fnr, size     uint32
+	sent          time.Time // time of the first transmission of the last fragment
+	retransmitted bool      // no round-trip time samples after retransmissions
+	received      int       // number of leading fragments the peer has, from its asks
+}
+
+// A fragment to send again, see retransmitFragments.
+type rtxFragment struct {
+	pkt *sendPacket
+	i   int
+}
+
+// retransmitFragments sends the fragments queued by handlePackets, paced by
+// congestion control like new fragments.
+func (c *Conn) retransmitFragments() {
+	for {
+		select {
+		case <-c.quit:
+			return
+		case f := <-c.rtxchan:
+			if err := c.congestion.pace(false, c.quit, nil); err != nil {
+				return
+			}
+			p := f.pkt
+			c.writeFragment(p.fragments[f.i], p.fnr+uint32(f.i), p.fnr, p.size)
+		}
+	}
 }
 
 func (c *Conn) writeFragment(frag []byte, nr, fnr, size uint32) {
@@ -382,14 +603,36 @@ func (c *Conn) writeFragment(frag []byte, nr, fnr, size uint32) {
 	buf.WriteTo(c.writer)
 }
 
-// Write a full message to c.
+// Write a full message to c. Blocks while the send window is full, see
+// SetSendWindow.
 func (c *Conn) Write(b []byte) (n int, err error) {
 	select {
 	case <-c.quit:
 		return 0, ErrConnectionClosed(c.closereason)
 	default:
 	}
+	deadline := c.wdeadline.wait()
+	if isClosed(deadline) {
+		return 0, timeoutError{}
+	}
 	cnt := FragmentCnt(len(b))
+	if err := c.window.acquire(len(b), cnt, c.quit, deadline); err != nil {
+		if err == errQuit {
+			err = ErrConnectionClosed(c.closereason)
+		}
+		return 0, err
+	}
+	c.writemu.Lock()
+	defer c.writemu.Unlock()
+	// Wait for the congestion window before allocating sequence numbers.
+	if err := c.congestion.sendFragment(true, c.quit, deadline); err != nil {
+		if err == errQuit {
+			return 0, ErrConnectionClosed(c.closereason)
+		}
+		// Nothing was sent, give the space back.
+		c.window.release(len(b), cnt)
+		return 0, err
+	}
 	// Allocate sequence numbers for all fragments.
 	fnr := atomic.AddUint32(&c.oPacketCounter, uint32(cnt)) - uint32(cnt)
 	// Copy the buffer as we have to keep the data for retransmissions.
@@ -402,14 +645,30 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 			high = len(b)
 		}
 		fragments[i] = bc[i*MaxDataSize : high]
-		c.writeFragment(fragments[i], fnr+uint32(i), fnr, size)
 	}
-	// Move the packet over to the handlePackets loop for retransmissions.
-	c.sendchan <- sendPacket{
+	pkt := &sendPacket{
 		fragments: fragments,
 		fnr:       fnr,
 		size:      size,
 	}
+	for i := range fragments {
+		// The write deadline doesn't apply here: Once we started sending
+		// a message, we have to send all of it.
+		if i > 0 {
+			if err := c.congestion.sendFragment(false, c.quit, nil); err != nil {
+				return 0, ErrConnectionClosed(c.closereason)
+			}
+		}
+		// Only announce sent fragments in Check packets, the peer would
+		// ask for the others. Count the fragment before sending it, so
+		// that a fast acknowledgement isn't rejected.
+		atomic.StoreUint32(&c.oPacketsSent, fnr+uint32(i)+1)
+		c.writeFragment(fragments[i], fnr+uint32(i), fnr, size)
+	}
+	// RTT samples are taken when the last fragment is acknowledged.
+	pkt.sent = time.Now()
+	// Move the packet over to the handlePackets loop for retransmissions.
+	c.sendchan <- pkt
 	return len(b), nil
 }
 
@@ -436,6 +695,12 @@ func (c *Conn) SendTest(raddr *net.UDPAddr) error {
 }
 
 func (c *Conn) Close() error {
+	return c.closeWithReason("connection closed locally", true)
+}
+
+// closeWithReason closes the connection, sending an IPID_Close packet to the
+// peer if sendpacket is set.
+func (c *Conn) closeWithReason(reason string, sendpacket bool) error {
 	// Closing a channel twice panics, so we have to protect this with a mutex.
 	c.closemutex.Lock()
 	defer c.closemutex.Unlock()
@@ -444,18 +709,18 @@ func (c *Conn) Close() error {
 		return ErrConnectionClosed(c.closereason)
 	default:
 	}
+	// Set the reason before closing quit so that readers observe it.
+	c.closereason = reason
 	close(c.quit)
 
-	if c.closereason == "" {
-		c.closereason = "connection closed locally"
-	}
-	if !c.noclosepacket {
+	if sendpacket && !c.noclosepacket {
 		// Send IPID_Close packet to server
 		closePacket := NewClosePacket(*c.raddr)
 		_, _ = closePacket.WriteTo(c.writer)
 	}
 	var err error
-	if c.writer == c.udp {
+	if c.closechan == nil {
+		// Dial created the socket for this connection only.
 		err = c.udp.Close()
 	} else {
 		// We don't own the UDP socket, so we don't have to close it.
@@ -474,21 +739,39 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.raddr
 }
 
+// ExternalAddr returns the local address as seen by the peer, i.e. the public
+// address if there's a NAT in between. The peer reports it during the
+// handshake, so it's only known for connections from Dial, nil otherwise.
+func (c *Conn) ExternalAddr() *net.UDPAddr {
+	return c.laddr
+}
+
+// SetDeadline sets the read and write deadlines of c. The deadlines only
+// apply to this connection, not to the underlying UDP socket.
 func (c *Conn) SetDeadline(t time.Time) error {
-	return c.udp.SetDeadline(t)
+	c.rdeadline.set(t)
+	c.wdeadline.set(t)
+	return nil
 }
 
+// SetReadDeadline sets the deadline for Read waiting for a message.
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	return c.udp.SetReadDeadline(t)
+	c.rdeadline.set(t)
+	return nil
 }
 
+// SetWriteDeadline sets the deadline for Write waiting for the send window
+// and congestion control. Once Write started sending a message, it finishes
+// regardless of the deadline.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	return c.udp.SetWriteDeadline(t)
+	c.wdeadline.set(t)
+	return nil
 }
 
 // For sorting with sort package.
+// uint32Slice sorts packet numbers in sequence order.
 type uint32Slice []uint32
 
 func (p uint32Slice) Len() int           { return len(p) }
-func (p uint32Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uint32Slice) Less(i, j int) bool { return seqLess(p[i], p[j]) }
 func (p uint32Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
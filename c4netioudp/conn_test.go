@@ -0,0 +1,378 @@
+package c4netioudp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeWriter delivers packets to another Conn in memory, like a UDP socket.
+type pipeWriter struct {
+	to   *Conn
+	addr *net.UDPAddr      // source address seen by the receiver
+	drop func([]byte) bool // decides whether a packet gets lost, may be nil
+	mu   sync.Mutex
+}
+
+func (w *pipeWriter) setDrop(drop func([]byte) bool) {
+	w.mu.Lock()
+	w.drop = drop
+	w.mu.Unlock()
+}
+
+func dropAll([]byte) bool { return true }
+
+func (w *pipeWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	lost := w.drop != nil && w.drop(b)
+	w.mu.Unlock()
+	if lost {
+		return len(b), nil
+	}
+	buf := append([]byte(nil), b...)
+	select {
+	case w.to.rfuchan <- rfu{buf: buf, n: len(buf), addr: w.addr}:
+	default:
+		// Full receive buffer, the packet is lost.
+	}
+	return len(b), nil
+}
+
+// pipeConns returns two established Conns connected in memory. dropA and
+// dropB decide which packets sent by a and b get lost.
+func pipeConns(t *testing.T, dropA, dropB func([]byte) bool) (a, b *Conn) {
+	return pipeConnsAt(t, 0, dropA, dropB)
+}
+
+// pipeConnsAt is like pipeConns, with packet numbers starting at nr.
+func pipeConnsAt(t *testing.T, nr uint32, dropA, dropB func([]byte) bool) (a, b *Conn) {
+	addrA := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 11112}
+	addrB := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 11112}
+	a, b = newConn(), newConn()
+	a.raddr, b.raddr = addrB, addrA
+	a.writer = &pipeWriter{to: b, addr: addrA, drop: dropA}
+	b.writer = &pipeWriter{to: a, addr: addrB, drop: dropB}
+	a.closechan = make(chan *Conn, 1)
+	b.closechan = make(chan *Conn, 1)
+	for _, c := range []*Conn{a, b} {
+		c.oPacketCounter, c.oPacketsSent, c.initialONr, c.initialINr = nr, nr, nr, nr
+	}
+	go a.handlePackets()
+	go b.handlePackets()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return
+}
+
+// dropFirstData loses the first transmission of data fragments starting at
+// from.
+func dropFirstData(from uint32) func([]byte) bool {
+	seen := make(map[uint32]bool)
+	return func(b []byte) bool {
+		hdr, _ := ReadPacketHdr(b)
+		if hdr.StatusByte&0x7f != IPID_Data || seqLess(hdr.Nr, from) || seen[hdr.Nr] {
+			return false
+		}
+		seen[hdr.Nr] = true
+		return true
+	}
+}
+
+// readTimeout reads a message from c, failing after d.
+func readTimeout(t *testing.T, c *Conn, d time.Duration) []byte {
+	select {
+	case data := <-c.datachan:
+		return data
+	case <-time.After(d):
+		t.Fatal("timeout waiting for data")
+	}
+	return nil
+}
+
+// Lost fragments are retransmitted after the RTO, long before the next
+// regular Check packet could ask for them.
+func TestRetransmission(t *testing.T) {
+	a, b := pipeConns(t, dropFirstData(1), nil)
+
+	// The first message gives us an RTT sample.
+	if _, err := a.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	readTimeout(t, b, 1*time.Second)
+
+	msg := bytes.Repeat([]byte("x"), 3*MaxDataSize)
+	start := time.Now()
+	if _, err := a.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTimeout(t, b, 2*time.Second); !bytes.Equal(got, msg) {
+		t.Fatalf("received %d bytes, expected %d", len(got), len(msg))
+	}
+	if d := time.Since(start); d >= checkInterval/2 {
+		t.Errorf("recovering from loss took %v", d)
+	}
+
+	// Packets after the retransmission arrive as well.
+	if _, err := a.Write([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTimeout(t, b, 2*time.Second); string(got) != "second" {
+		t.Errorf("received %q", got)
+	}
+}
+
+// Only lost fragments of a large message are sent again, after asks as well
+// as after the retransmission timeout.
+func TestSelectiveRetransmission(t *testing.T) {
+	// The retransmission after b's ask gets lost as well.
+	const lost = 12
+	var mu sync.Mutex
+	sent := make(map[uint32]int)
+	a, b := pipeConns(t, func(b []byte) bool {
+		hdr, _ := ReadPacketHdr(b)
+		if hdr.StatusByte&0x7f != IPID_Data {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		sent[hdr.Nr]++
+		return hdr.Nr == lost && sent[hdr.Nr] <= 2
+	}, nil)
+
+	// The first message gives us an RTT sample, so that the retransmission
+	// timer expires before the next regular Check packet.
+	if _, err := a.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	readTimeout(t, b, 1*time.Second)
+
+	msg := bytes.Repeat([]byte("x"), 20*MaxDataSize)
+	if _, err := a.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTimeout(t, b, 2*time.Second); !bytes.Equal(got, msg) {
+		t.Fatalf("received %d bytes, expected %d", len(got), len(msg))
+	}
+	// Give stray retransmissions time to show up.
+	time.Sleep(2 * minRTO)
+	mu.Lock()
+	defer mu.Unlock()
+	for nr := uint32(1); nr <= 20; nr++ {
+		if nr == lost && sent[nr] < 3 {
+			t.Errorf("lost fragment %d sent %d times", nr, sent[nr])
+		} else if nr != lost && sent[nr] != 1 {
+			t.Errorf("fragment %d sent %d times", nr, sent[nr])
+		}
+	}
+}
+
+// Check packets acknowledging packets that weren't sent yet are rejected.
+func TestCheckAcknowledgingUnsent(t *testing.T) {
+	a, _ := pipeConns(t, nil, dropAll)
+	invalid := make(chan error, 1)
+	a.invalidPacket = func(addr *net.UDPAddr, err error) {
+		select {
+		case invalid <- err:
+		default:
+		}
+	}
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	check := NewCheckPacketHdr(nil, 5, 0)
+	check.WriteTo(&buf)
+	a.rfuchan <- rfu{buf: buf.Bytes(), n: buf.Len(), addr: a.raddr}
+	select {
+	case <-invalid:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Check packet not rejected")
+	}
+	a.congestion.mu.Lock()
+	defer a.congestion.mu.Unlock()
+	if a.congestion.inflight != 1 {
+		t.Errorf("%d fragments in flight, expected 1", a.congestion.inflight)
+	}
+}
+
+// Write blocks while the send window is full.
+func TestSendWindow(t *testing.T) {
+	a, b := pipeConns(t, nil, dropAll)
+	a.SetSendWindow(0, 2)
+
+	for i := 0; i < 2; i++ {
+		if _, err := a.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		readTimeout(t, b, 1*time.Second)
+	}
+	a.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := a.Write([]byte("hello")); !isTimeout(err) {
+		t.Fatalf("Write() with full window: %v, expected timeout", err)
+	}
+
+	// The window opens once b acknowledges the data.
+	a.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.Write([]byte("hello"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Write() didn't block: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.writer.(*pipeWriter).setDrop(nil)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * checkInterval):
+		t.Fatal("window didn't open")
+	}
+	readTimeout(t, b, 1*time.Second)
+
+	// Blocked writers return when the connection closes.
+	b.writer.(*pipeWriter).setDrop(dropAll)
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	a.SetSendWindow(1, 0)
+	go func() {
+		_, err := a.Write([]byte("hello"))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	a.Close()
+	select {
+	case err := <-done:
+		if _, ok := err.(ErrConnectionClosed); !ok {
+			t.Errorf("Write() after close: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Write() still blocked after close")
+	}
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+// Read and Write return timeout errors after their deadlines.
+func TestDeadlines(t *testing.T) {
+	a, b := pipeConns(t, nil, nil)
+
+	// Deadlines in the past apply immediately, even with data available.
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := b.Read(make([]byte, 10)); !isTimeout(err) {
+		t.Fatalf("Read() after deadline: %v, expected timeout", err)
+	}
+	a.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := a.Write([]byte("hello")); !isTimeout(err) {
+		t.Fatalf("Write() after deadline: %v, expected timeout", err)
+	}
+
+	// Clearing the deadlines makes both work again.
+	a.SetWriteDeadline(time.Time{})
+	b.SetReadDeadline(time.Time{})
+	buf := make([]byte, 10)
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+
+	// A blocked Read returns when the deadline expires.
+	start := time.Now()
+	b.SetReadDeadline(start.Add(50 * time.Millisecond))
+	if _, err := b.Read(buf); !isTimeout(err) {
+		t.Fatalf("Read() without data: %v, expected timeout", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > 1*time.Second {
+		t.Errorf("Read() returned after %v", d)
+	}
+
+	// Extending the deadline of a blocked Read lets it receive data.
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.Read(buf)
+		done <- err
+	}()
+	b.SetReadDeadline(time.Now().Add(1 * time.Second))
+	time.Sleep(100 * time.Millisecond)
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Read() after extending the deadline: %v", err)
+	}
+}
+
+// Read reports messages which don't fit into the buffer.
+func TestShortBuffer(t *testing.T) {
+	a, b := pipeConns(t, nil, nil)
+	b.SetReadDeadline(time.Now().Add(1 * time.Second))
+
+	if _, err := a.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if n, err := b.Read(buf); err != io.ErrShortBuffer || string(buf[:n]) != "hello" {
+		t.Errorf("Read() = %q, %v, expected io.ErrShortBuffer", buf[:n], err)
+	}
+
+	// The rest of the message is gone.
+	if _, err := a.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "hi" {
+		t.Errorf("Read() = %q, %v", buf[:n], err)
+	}
+
+	msg := bytes.Repeat([]byte("x"), 3*MaxDataSize)
+	if _, err := a.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := b.ReadMessage(); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("ReadMessage() = %d bytes, %v", len(got), err)
+	}
+}
+
+func TestRTTEstimator(t *testing.T) {
+	e := newRTTEstimator()
+	if e.rto != initialRTO {
+		t.Errorf("initial RTO %v", e.rto)
+	}
+	e.sample(400 * time.Millisecond)
+	// SRTT = R, RTTVAR = R/2, RTO = SRTT + 4*RTTVAR
+	if e.srtt != 400*time.Millisecond || e.rttvar != 200*time.Millisecond || e.rto != 1200*time.Millisecond {
+		t.Errorf("after first sample: %+v", e)
+	}
+	e.sample(200 * time.Millisecond)
+	// RTTVAR = 3/4*200 + 1/4*200, SRTT = 7/8*400 + 1/8*200
+	if e.srtt != 375*time.Millisecond || e.rttvar != 200*time.Millisecond || e.rto != 1175*time.Millisecond {
+		t.Errorf("after second sample: %+v", e)
+	}
+	for i := 0; i < 100; i++ {
+		e.sample(1 * time.Millisecond)
+	}
+	if e.rto != minRTO {
+		t.Errorf("RTO %v below minimum", e.rto)
+	}
+	for i := 0; i < 10; i++ {
+		e.backoff()
+	}
+	if e.rto != maxRTO {
+		t.Errorf("RTO %v above maximum", e.rto)
+	}
+}
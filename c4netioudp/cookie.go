@@ -0,0 +1,80 @@
+package c4netioudp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Handshake cookies
+//
+// Normally, the listener creates a Conn as soon as it receives a ConnPacket.
+// Attackers sending ConnPackets with spoofed source addresses can thus fill
+// the listener with half-open connections and make it send ConnPacket
+// replies to their victims.
+//
+// In cookie mode, the listener replies to ConnPackets without keeping any
+// state. The reply's packet number, which becomes the first sequence number
+// for data we send, is an HMAC of the peer's address and the current time
+// slot. We can't verify the ConnOkPacket as C4NetIOUDP doesn't echo anything
+// from our ConnPacket in it. However, the peer initializes its incoming packet
+// counter from our packet number and acknowledges it in the AckNr field of its
+// Check packets. The first Check packet with a valid cookie as AckNr
+// establishes the connection, the ConnOkPacket is ignored.
+//
+// A peer reconnecting from the same address without closing its old
+// connection has to get a different cookie, otherwise its Check packets would
+// look like those of the old connection. The cookie thus also depends on the
+// first packet number of an existing connection from the address.
+//
+// Peers send Check packets every second, so connecting takes up to a second
+// longer. Our own Conn sends a Check packet right after the ConnOkPacket.
+
+// Length of a cookie time slot. Cookies from the current and the previous
+// slot are valid.
+const cookieSlot = connTimeout
+
+type cookieJar struct {
+	secret [32]byte
+}
+
+func newCookieJar() (*cookieJar, error) {
+	var j cookieJar
+	if _, err := rand.Read(j.secret[:]); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func (j *cookieJar) cookieForSlot(addr *net.UDPAddr, prev uint32, slot int64) uint32 {
+	mac := hmac.New(sha256.New, j.secret[:])
+	var buf [12]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(slot))
+	binary.LittleEndian.PutUint32(buf[8:], prev)
+	mac.Write(buf[:])
+	mac.Write([]byte(addrkey(addr)))
+	return binary.LittleEndian.Uint32(mac.Sum(nil))
+}
+
+// cookie returns the cookie for a connection attempt from addr. prev is the
+// initial packet number of the existing connection from addr, or zero.
+func (j *cookieJar) cookie(addr *net.UDPAddr, prev uint32, now time.Time) uint32 {
+	return j.cookieForSlot(addr, prev, now.UnixNano()/int64(cookieSlot))
+}
+
+// valid reports whether c is a recent cookie for addr and prev.
+func (j *cookieJar) valid(addr *net.UDPAddr, prev uint32, c uint32, now time.Time) bool {
+	slot := now.UnixNano() / int64(cookieSlot)
+	return c == j.cookieForSlot(addr, prev, slot) || c == j.cookieForSlot(addr, prev, slot-1)
+}
+
+// prevNr returns the prev argument for cookies from conn's address.
+func prevNr(conn *Conn) uint32 {
+	if conn == nil {
+		return 0
+	}
+	return conn.initialONr
+}
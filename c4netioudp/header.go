@@ -2,9 +2,25 @@ package c4netioudp
 
 import "bytes"
 import "encoding/binary"
+import "fmt"
 import "io"
 import "net"
 
+// Packet not properly formatted.
+type ErrInvalidPacket string
+
+func (msg ErrInvalidPacket) Error() string {
+	return fmt.Sprintf("c4netioudp: invalid packet: %s", string(msg))
+}
+
+// checkSize returns an error if b is shorter than size.
+func checkSize(b []byte, size int, what string) error {
+	if len(b) < size {
+		return ErrInvalidPacket(fmt.Sprintf("%s too short, %d < %d byte", what, len(b), size))
+	}
+	return nil
+}
+
 // struct BinAddr
 // {
 // 	uint16_t port;
@@ -17,13 +33,19 @@ import "net"
 // };
 const binAddrSize = 2 + 1 + 16
 
-func readBinAddr(b []byte) (addr net.UDPAddr) {
+func readBinAddr(b []byte) (addr net.UDPAddr, err error) {
+	if err = checkSize(b, binAddrSize, "address"); err != nil {
+		return
+	}
 	addr.Port = int(binary.LittleEndian.Uint16(b[0:]))
 	switch b[2] {
+	case 0: // unset
 	case 1: // IPv4
 		addr.IP = net.IPv4(b[3], b[4], b[5], b[6])
 	case 2: // IPv6
 		addr.IP = append([]byte(nil), b[3:19]...)
+	default:
+		err = ErrInvalidPacket(fmt.Sprintf("unknown address type %d", b[2]))
 	}
 	return
 }
@@ -31,7 +53,10 @@ func readBinAddr(b []byte) (addr net.UDPAddr) {
 // Note: assumes that writing can't fail, i.e. w has to be a bytes.Buffer
 func writeBinAddr(w io.Writer, addr *net.UDPAddr) {
 	binary.Write(w, binary.LittleEndian, uint16(addr.Port))
-	if v4 := addr.IP.To4(); v4 != nil {
+	if addr.IP == nil {
+		// Unset address, as read by readBinAddr
+		w.Write(make([]byte, binAddrSize-2))
+	} else if v4 := addr.IP.To4(); v4 != nil {
 		w.Write([]byte{1})
 		w.Write(v4)
 		// Pad the rest of the union with 0
@@ -64,11 +89,13 @@ type PacketHdr struct {
 	Nr         uint32 // packet nr
 }
 
-func ReadPacketHdr(b []byte) PacketHdr {
-	var hdr PacketHdr
+func ReadPacketHdr(b []byte) (hdr PacketHdr, err error) {
+	if err = checkSize(b, PacketHdrSize, "packet"); err != nil {
+		return
+	}
 	hdr.StatusByte = b[0]
 	hdr.Nr = binary.LittleEndian.Uint32(b[1:])
-	return hdr
+	return
 }
 
 func (hdr *PacketHdr) WriteTo(w io.Writer) (n int64, err error) {
@@ -98,11 +125,16 @@ func NewConnPacket(addr net.UDPAddr) ConnPacket {
 	}
 }
 
-func ReadConnPacket(b []byte) (pkg ConnPacket) {
-	pkg.PacketHdr = ReadPacketHdr(b)
+func ReadConnPacket(b []byte) (pkg ConnPacket, err error) {
+	if err = checkSize(b, ConnPacketSize, "ConnPacket"); err != nil {
+		return
+	}
+	pkg.PacketHdr, _ = ReadPacketHdr(b)
 	pkg.ProtocolVer = binary.LittleEndian.Uint32(b[PacketHdrSize:])
-	pkg.Addr = readBinAddr(b[PacketHdrSize+4:])
-	pkg.MCAddr = readBinAddr(b[PacketHdrSize+4+binAddrSize:])
+	if pkg.Addr, err = readBinAddr(b[PacketHdrSize+4:]); err != nil {
+		return
+	}
+	pkg.MCAddr, err = readBinAddr(b[PacketHdrSize+4+binAddrSize:])
 	return
 }
 
@@ -142,10 +174,17 @@ func NewConnOkPacket(addr net.UDPAddr) ConnOkPacket {
 	}
 }
 
-func ReadConnOkPacket(b []byte) (pkg ConnOkPacket) {
-	pkg.PacketHdr = ReadPacketHdr(b)
+func ReadConnOkPacket(b []byte) (pkg ConnOkPacket, err error) {
+	if err = checkSize(b, ConnOkPacketSize, "ConnOkPacket"); err != nil {
+		return
+	}
+	pkg.PacketHdr, _ = ReadPacketHdr(b)
 	pkg.MCMode = binary.LittleEndian.Uint32(b[PacketHdrSize:])
-	pkg.Addr = readBinAddr(b[PacketHdrSize+4:])
+	if pkg.MCMode > MCM_MCOK {
+		err = ErrInvalidPacket(fmt.Sprintf("unknown multicast mode %d", pkg.MCMode))
+		return
+	}
+	pkg.Addr, err = readBinAddr(b[PacketHdrSize+4:])
 	return
 }
 
@@ -196,8 +235,11 @@ func NewDataPacketHdr(nr, fnr, size uint32) DataPacketHdr {
 	}
 }
 
-func ReadDataPacketHdr(b []byte) (pkg DataPacketHdr) {
-	pkg.PacketHdr = ReadPacketHdr(b)
+func ReadDataPacketHdr(b []byte) (pkg DataPacketHdr, err error) {
+	if err = checkSize(b, DataPacketHdrSize, "DataPacketHdr"); err != nil {
+		return
+	}
+	pkg.PacketHdr, _ = ReadPacketHdr(b)
 	pkg.FNr = binary.LittleEndian.Uint32(b[PacketHdrSize:])
 	pkg.Size = binary.LittleEndian.Uint32(b[PacketHdrSize+4:])
 	return
@@ -232,14 +274,22 @@ func NewCheckPacketHdr(ask []uint32, acknr, outacknr uint32) CheckPacketHdr {
 	}
 }
 
-func ReadCheckPacketHdr(b []byte) (pkg CheckPacketHdr) {
-	pkg.PacketHdr = ReadPacketHdr(b)
+func ReadCheckPacketHdr(b []byte) (pkg CheckPacketHdr, err error) {
+	if err = checkSize(b, CheckPacketHdrSize, "CheckPacketHdr"); err != nil {
+		return
+	}
+	pkg.PacketHdr, _ = ReadPacketHdr(b)
 	AskCount := binary.LittleEndian.Uint32(b[PacketHdrSize:])
 	MCAskCount := binary.LittleEndian.Uint32(b[PacketHdrSize+4:])
 	pkg.AckNr = binary.LittleEndian.Uint32(b[PacketHdrSize+8:])
 	pkg.MCAckNr = binary.LittleEndian.Uint32(b[PacketHdrSize+12:])
-	// Read Ask and MCAsk arrays following the header.
-	// TODO: Verify that b is large enough.
+	// Read Ask and MCAsk arrays following the header. The arrays have to
+	// fill the rest of the packet exactly. Check the counts before
+	// allocating anything.
+	if uint64(CheckPacketHdrSize)+4*(uint64(AskCount)+uint64(MCAskCount)) != uint64(len(b)) {
+		err = ErrInvalidPacket(fmt.Sprintf("CheckPacketHdr with %d + %d asks in %d byte", AskCount, MCAskCount, len(b)))
+		return
+	}
 	pkg.Ask = make([]uint32, AskCount)
 	pkg.MCAsk = make([]uint32, MCAskCount)
 	pos := CheckPacketHdrSize
@@ -284,9 +334,12 @@ func NewClosePacket(addr net.UDPAddr) ClosePacket {
 	}
 }
 
-func ReadClosePacket(b []byte) (pkg ClosePacket) {
-	pkg.PacketHdr = ReadPacketHdr(b)
-	pkg.Addr = readBinAddr(b[PacketHdrSize:])
+func ReadClosePacket(b []byte) (pkg ClosePacket, err error) {
+	if err = checkSize(b, ClosePacketSize, "ClosePacket"); err != nil {
+		return
+	}
+	pkg.PacketHdr, _ = ReadPacketHdr(b)
+	pkg.Addr, err = readBinAddr(b[PacketHdrSize:])
 	return
 }
 
@@ -0,0 +1,56 @@
+//go:build go1.18
+// +build go1.18
+
+package c4netioudp
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// FuzzReadPacket checks that the readers don't panic, agree with the
+// reference decoder and that decoded packets encode to the same packet.
+func FuzzReadPacket(f *testing.F) {
+	files, err := filepath.Glob("testdata/layout/*.hex")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range files {
+		f.Add(readHex(f, name))
+	}
+	for _, p := range []io.WriterTo{
+		&PacketHdr{StatusByte: IPID_Ping},
+		&PacketHdr{StatusByte: IPID_Test},
+		&UnreliablePacketHdr{PacketHdr{StatusByte: IPID_Test}, 3},
+		&CheckPacketHdr{PacketHdr: PacketHdr{StatusByte: IPID_Check}, Ask: []uint32{1}, MCAsk: []uint32{2, 3}},
+	} {
+		var buf bytes.Buffer
+		p.WriteTo(&buf)
+		f.Add(buf.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		pkt, err := readAny(b)
+		ref, referr := refDecode(b)
+		if (err == nil) != (referr == nil) {
+			t.Fatalf("readAny: %v, refDecode: %v", err, referr)
+		}
+		if err != nil {
+			return
+		}
+		if !reflect.DeepEqual(pkt, ref) {
+			t.Fatalf("readAny: %+v, refDecode: %+v", pkt, ref)
+		}
+		p := reflect.New(reflect.TypeOf(pkt))
+		p.Elem().Set(reflect.ValueOf(pkt))
+		var buf bytes.Buffer
+		p.Interface().(io.WriterTo).WriteTo(&buf)
+		again, err := readAny(buf.Bytes())
+		if err != nil || !reflect.DeepEqual(again, pkt) {
+			t.Fatalf("%+v encoded as %x, decoded as %+v, %v", pkt, buf.Bytes(), again, err)
+		}
+	})
+}
@@ -1,6 +1,8 @@
 package c4netioudp
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"time"
@@ -8,8 +10,42 @@ import (
 
 const connTimeout = 5 * time.Second // initial connection timeout (ConnPacket to ConnOkPacket)
 
+// Returned by Listener methods after Close.
+var errListenerClosed = errors.New("c4netioudp: listener closed")
+
+// Interval in which the listener drops timed out handshakes
+const handshakeSweepInterval = 1 * time.Second
+
+// ListenConfig contains options for listening. The zero value has no limits.
+type ListenConfig struct {
+	MaxConns      int // maximum number of established connections
+	MaxHalfOpen   int // maximum number of connection handshakes in progress
+	MaxConnsPerIP int // maximum number of established and half-open connections per IP
+
+	// Reply to refused connection attempts with an IPID_Close packet
+	// instead of ignoring them.
+	SendCloseOnRefuse bool
+
+	// Don't keep any state for connection attempts. See cookie.go.
+	// MaxHalfOpen doesn't apply in this mode.
+	Cookies bool
+
+	// InvalidPacket is called with packets which are dropped because they
+	// are malformed or don't fit the connection state. It is called from
+	// the goroutines of the listener and its connections concurrently.
+	InvalidPacket func(addr *net.UDPAddr, err error)
+
+	// UnhandledPacket is called with packets from addresses without a
+	// connection which aren't connection attempts, for example to receive
+	// plain UDP messages on the listener's socket. It is called from the
+	// listener's goroutine and must not block. b isn't reused.
+	UnhandledPacket func(addr *net.UDPAddr, b []byte)
+}
+
 type Listener struct {
-	udp        *net.UDPConn
+	udp        PacketConn
+	config     ListenConfig
+	cookies    *cookieJar // set in cookie mode
 	acceptchan chan *Conn // channel for new connections
 	closechan  chan *Conn // channel to signal a closing connection
 	dialchan   chan *Conn // channel for new outgoing connections
@@ -19,7 +55,35 @@ type Listener struct {
 }
 
 func Listen(network string, laddr *net.UDPAddr) (*Listener, error) {
+	var lc ListenConfig
+	return lc.Listen(network, laddr)
+}
+
+// ListenPacket creates a listener on an existing socket.
+func ListenPacket(pc PacketConn) (*Listener, error) {
+	var lc ListenConfig
+	return lc.ListenPacket(pc)
+}
+
+// Listen creates a listener limiting connections as configured in lc.
+func (lc *ListenConfig) Listen(network string, laddr *net.UDPAddr) (*Listener, error) {
+	udp, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	l, err := lc.ListenPacket(udp)
+	if err != nil {
+		udp.Close()
+	}
+	return l, err
+}
+
+// ListenPacket creates a listener on pc like Listen. The listener takes
+// ownership of pc and closes it in Close.
+func (lc *ListenConfig) ListenPacket(pc PacketConn) (*Listener, error) {
 	l := Listener{
+		udp:        pc,
+		config:     *lc,
 		acceptchan: make(chan *Conn, 32),
 		closechan:  make(chan *Conn, 32),
 		dialchan:   make(chan *Conn),
@@ -28,9 +92,10 @@ func Listen(network string, laddr *net.UDPAddr) (*Listener, error) {
 		quithp:     make(chan bool),
 	}
 	var err error
-	l.udp, err = net.ListenUDP(network, laddr)
-	if err != nil {
-		return nil, err
+	if lc.Cookies {
+		if l.cookies, err = newCookieJar(); err != nil {
+			return nil, err
+		}
 	}
 	go l.handlePackets()
 	return &l, nil
@@ -51,20 +116,51 @@ func (l *Listener) newConnTo(raddr *net.UDPAddr) *Conn {
 	conn.raddr = raddr
 	conn.writer = writer
 	conn.closechan = l.closechan
+	conn.invalidPacket = l.config.InvalidPacket
 	return conn
 }
 
+// A connection waiting for ConnOk
+type halfOpen struct {
+	conn     *Conn
+	deadline time.Time
+}
+
+// refuse rejects a connection attempt from addr.
+func (l *Listener) refuse(addr *net.UDPAddr) {
+	if l.config.SendCloseOnRefuse {
+		closePacket := NewClosePacket(*addr)
+		_, _ = closePacket.WriteTo(writerToUDP{l.udp, addr})
+	}
+}
+
+// reportInvalid passes errors about dropped packets to the hook.
+func (l *Listener) reportInvalid(addr *net.UDPAddr, err error) {
+	if l.config.InvalidPacket != nil {
+		l.config.InvalidPacket(addr, err)
+	}
+}
+
 func (l *Listener) handlePackets() {
 	rfuchan := make(chan rfu)
 	go readFromUDP(l.udp, rfuchan, l.quit)
 	// fully opened connections
 	conns := make(map[udpkey]*Conn)
 	// incoming connections where we're still waiting for ConnOk
-	connsinprogress := make(map[udpkey]*Conn)
+	connsinprogress := make(map[udpkey]halfOpen)
 	// outgoing connections - managed in Dial() and Conn
 	dials := make(map[udpkey]*Conn)
+	// number of established and half-open connections per IP
+	perip := make(map[string]int)
+	countIP := func(addr *net.UDPAddr, delta int) {
+		key := addr.IP.String()
+		if perip[key] += delta; perip[key] <= 0 {
+			delete(perip, key)
+		}
+	}
 	// connection timeouts
-	conntimeout := make(chan udpkey)
+	sweep := time.NewTicker(handshakeSweepInterval)
+	defer sweep.Stop()
 	for {
 		select {
 		case <-l.quithp:
@@ -81,8 +177,13 @@ func (l *Listener) handlePackets() {
 		case c := <-l.closechan:
 			// Remove the channel from the map of open connections.
 			key := addrkey(c.raddr)
-			delete(conns, key)
-			delete(dials, key)
+			if conns[key] == c {
+				delete(conns, key)
+				countIP(c.raddr, -1)
+			}
+			if dials[key] == c {
+				delete(dials, key)
+			}
 		case c := <-l.dialchan:
 			dials[addrkey(c.raddr)] = c
 		case r := <-rfuchan:
@@ -99,17 +200,45 @@ func (l *Listener) handlePackets() {
 			// Do we already have a connection for this address?
 			conn := conns[key]
 			// Decode packet to find connection attempts.
-			hdr := ReadPacketHdr(r.buf)
+			b := r.buf[:r.n]
+			hdr, err := ReadPacketHdr(b)
+			if err != nil {
+				l.reportInvalid(r.addr, err)
+				continue
+			}
 			switch hdr.StatusByte & 0x7f {
 			case IPID_Conn:
-				if r.n < ConnPacketSize {
+				if _, err := ReadConnPacket(b); err != nil {
+					l.reportInvalid(r.addr, err)
+					continue
+				}
+				if l.cookies != nil {
+					// Reply without keeping any state. A re-connection will
+					// replace the old connection once it is verified.
+					connrepkg := NewConnPacket(*r.addr)
+					connrepkg.Nr = l.cookies.cookie(r.addr, prevNr(conn), time.Now())
+					connrepkg.WriteTo(writerToUDP{l.udp, r.addr})
+					continue
+				}
+				if ho, ok := connsinprogress[key]; ok {
+					// Our reply went missing, send it again.
+					connrepkg := NewConnPacket(*r.addr)
+					connrepkg.WriteTo(ho.conn.writer)
+					ho.deadline = time.Now().Add(connTimeout)
+					connsinprogress[key] = ho
 					continue
 				}
 				if conn != nil {
 					// This is a re-connection, close the old connection.
-					conn.closereason = "reconnection"
-					conn.noclosepacket = true
-					conn.Close()
+					conn.closeWithReason("reconnection", false)
+					delete(conns, key)
+					countIP(r.addr, -1)
+				}
+				if l.config.MaxConns > 0 && len(conns) >= l.config.MaxConns ||
+					l.config.MaxHalfOpen > 0 && len(connsinprogress) >= l.config.MaxHalfOpen ||
+					l.config.MaxConnsPerIP > 0 && perip[r.addr.IP.String()] >= l.config.MaxConnsPerIP {
+					l.refuse(r.addr)
+					continue
 				}
 				// There's no need to read the initial ConnPacket, the client
 				// does all version checks. We may need to read the packet here
@@ -117,45 +246,98 @@ func (l *Listener) handlePackets() {
 				conn := l.newConnTo(r.addr)
 				connrepkg := NewConnPacket(*r.addr)
 				connrepkg.WriteTo(conn.writer)
-				connsinprogress[key] = conn
-				// Connection timeout
-				go func(key udpkey) {
-					time.Sleep(connTimeout)
-					conntimeout <- key
-				}(key)
+				connsinprogress[key] = halfOpen{conn, time.Now().Add(connTimeout)}
+				countIP(r.addr, 1)
 			case IPID_ConnOK:
-				if r.n < ConnOkPacketSize {
+				if _, err := ReadConnOkPacket(b); err != nil {
+					l.reportInvalid(r.addr, err)
 					continue
 				}
-				conn, ok := connsinprogress[key]
+				ho, ok := connsinprogress[key]
 				if !ok {
 					continue
 				}
 				// Nothing interesting in the packet itself as we don't support
 				// multicast.
 				delete(connsinprogress, key)
-				conns[key] = conn
-				go conn.handlePackets()
-				l.acceptchan <- conn
+				// Refuse instead of blocking if nobody accepts connections.
+				if l.config.MaxConns > 0 && len(conns) >= l.config.MaxConns ||
+					len(l.acceptchan) == cap(l.acceptchan) {
+					countIP(r.addr, -1)
+					l.refuse(r.addr)
+					continue
+				}
+				conns[key] = ho.conn
+				go ho.conn.handlePackets()
+				l.acceptchan <- ho.conn
+			case IPID_Check:
+				if l.cookies != nil {
+					// In cookie mode, the first Check packet acknowledging our
+					// ConnPacket establishes the connection.
+					check, err := ReadCheckPacketHdr(b)
+					if err != nil {
+						l.reportInvalid(r.addr, err)
+						continue
+					}
+					acknr := check.AckNr
+					if (conn == nil || acknr != conn.initialONr) && l.cookies.valid(r.addr, prevNr(conn), acknr, time.Now()) {
+						if conn != nil {
+							conn.closeWithReason("reconnection", false)
+							delete(conns, key)
+							countIP(r.addr, -1)
+						}
+						if l.config.MaxConns > 0 && len(conns) >= l.config.MaxConns ||
+							l.config.MaxConnsPerIP > 0 && perip[r.addr.IP.String()] >= l.config.MaxConnsPerIP ||
+							len(l.acceptchan) == cap(l.acceptchan) {
+							l.refuse(r.addr)
+							continue
+						}
+						conn = l.newConnTo(r.addr)
+						conn.oPacketCounter = acknr
+						conn.oPacketsSent = acknr
+						conn.initialONr = acknr
+						conns[key] = conn
+						countIP(r.addr, 1)
+						go conn.handlePackets()
+						l.acceptchan <- conn
+					}
+				}
+				if conn != nil {
+					conn.rfuchan <- r
+				}
 			default:
 				if conn != nil {
 					conn.rfuchan <- r
+				} else if l.config.UnhandledPacket != nil {
+					l.config.UnhandledPacket(r.addr, b)
+				}
+			}
+		case now := <-sweep.C:
+			for key, ho := range connsinprogress {
+				if now.After(ho.deadline) {
+					delete(connsinprogress, key)
+					countIP(ho.conn.raddr, -1)
 				}
 			}
-		case key := <-conntimeout:
-			delete(connsinprogress, key)
 		}
 	}
 }
 
 func (l *Listener) AcceptConn() (*Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext waits for the next connection until ctx is done.
+func (l *Listener) AcceptContext(ctx context.Context) (*Conn, error) {
 	select {
 	case conn := <-l.acceptchan:
 		return conn, nil
 	case err := <-l.errchan:
 		return nil, err
 	case <-l.quit:
-		return nil, fmt.Errorf("c4netioudp: listener closed")
+		return nil, errListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
@@ -163,21 +345,59 @@ func (l *Listener) Accept() (net.Conn, error) {
 	return l.AcceptConn()
 }
 
+// addDial registers an outgoing connection with handlePackets, which then
+// forwards all packets from its address. Closing the Conn removes it again.
+func (l *Listener) addDial(ctx context.Context, conn *Conn) error {
+	select {
+	case l.dialchan <- conn:
+		return nil
+	case <-l.quit:
+		return errListenerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (l *Listener) Punch(raddr *net.UDPAddr, timeout, interval time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := l.PunchContext(ctx, raddr, interval)
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("timeout")
+	}
+	return err
+}
+
+// PunchContext sends packets to raddr every interval until it receives
+// something from raddr or ctx is done.
+func (l *Listener) PunchContext(ctx context.Context, raddr *net.UDPAddr, interval time.Duration) error {
 	// Create a temporary Conn to have packet forwarding from the listener.
 	conn := l.newConnTo(raddr)
 	conn.noclosepacket = true
-	l.dialchan <- conn
+	if err := l.addDial(ctx, conn); err != nil {
+		return err
+	}
 	defer conn.Close()
-	return conn.punch(timeout, interval)
+	return conn.punch(ctx, interval)
 }
 
 func (l *Listener) Dial(raddr *net.UDPAddr) (*Conn, error) {
+	return l.DialContext(context.Background(), raddr)
+}
+
+// DialContext connects to raddr from the listener's socket. The handshake is
+// aborted when ctx is done. Without a deadline on ctx, it times out after
+// connTimeout.
+func (l *Listener) DialContext(ctx context.Context, raddr *net.UDPAddr) (*Conn, error) {
 	conn := l.newConnTo(raddr)
 	// Register with packet handler so that forwarding works.
-	l.dialchan <- conn
-	if err := conn.connect(); err != nil {
-		return nil, fmt.Errorf("c4netioudp: error while connecting: %v", err)
+	if err := l.addDial(ctx, conn); err != nil {
+		return nil, err
+	}
+	if err := conn.connect(ctx); err != nil {
+		// Unregister the dial without telling the peer.
+		conn.closeWithReason("connection failed", false)
+		return nil, fmt.Errorf("c4netioudp: error while connecting: %w", err)
 	}
 	go conn.handlePackets()
 	return conn, nil
@@ -192,6 +412,12 @@ func (l *Listener) Close() error {
 	return l.udp.Close()
 }
 
+// WriteTo sends b as a single UDP packet to addr, without any C4NetIOUDP
+// framing.
+func (l *Listener) WriteTo(b []byte, addr *net.UDPAddr) (int, error) {
+	return l.udp.WriteToUDP(b, addr)
+}
+
 func (l *Listener) Addr() net.Addr {
 	return l.udp.LocalAddr()
 }
@@ -1,9 +1,15 @@
 package c4netioudp
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
 	"net"
 	"testing"
 	"time"
+
+	"github.com/openclonk/netpuncher/c4netioudp/simnet"
 )
 
 // multiple connections from same address
@@ -99,3 +105,485 @@ func TestReconnecting(t *testing.T) {
 		t.Fatal("timeout")
 	}
 }
+
+// Deadlines of one Conn don't affect other Conns on the same Listener.
+func TestListenerDeadlines(t *testing.T) {
+	listener, err := Listen("udp", &net.UDPAddr{IP: net.IPv6loopback, Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	raddr := listener.Addr().(*net.UDPAddr)
+
+	var clients [2]*Conn
+	var conns [2]*Conn
+	for i := range clients {
+		clients[i], err = Dial("udp", nil, raddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer clients[i].Close()
+		conns[i], err = listener.AcceptConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conns[0].SetDeadline(time.Now().Add(-time.Second))
+	if _, err := conns[0].Read(nil); !isTimeout(err) {
+		t.Fatalf("Read() after deadline: %v, expected timeout", err)
+	}
+	if _, err := clients[1].Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conns[1].SetReadDeadline(time.Now().Add(1 * time.Second))
+	buf := make([]byte, 10)
+	if n, err := conns[1].Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+}
+
+// Cancelling a context stops DialContext, PunchContext and AcceptContext
+// and unregisters the dial.
+func TestContextCancel(t *testing.T) {
+	listener, err := Listen("udp", &net.UDPAddr{IP: net.IPv6loopback, Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// A peer which doesn't answer.
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback, Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paddr := peer.LocalAddr().(*net.UDPAddr)
+
+	cancelled := func(what string, f func(ctx context.Context) error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		if err := f(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: %v, expected cancellation", what, err)
+		}
+		if d := time.Since(start); d > 1*time.Second {
+			t.Errorf("%s returned after %v", what, d)
+		}
+	}
+	cancelled("PunchContext", func(ctx context.Context) error {
+		return listener.PunchContext(ctx, paddr, 10*time.Millisecond)
+	})
+	cancelled("AcceptContext", func(ctx context.Context) error {
+		_, err := listener.AcceptContext(ctx)
+		return err
+	})
+	cancelled("DialContext", func(ctx context.Context) error {
+		_, err := listener.DialContext(ctx, paddr)
+		return err
+	})
+
+	// Connections from the peer's address reach the listener again.
+	peer.Close()
+	c, err := Dial("udp", paddr, listener.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if _, err := listener.AcceptContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dialRaw sends a ConnPacket from a fresh socket without completing the
+// handshake.
+func dialRaw(t *testing.T, raddr *net.UDPAddr) {
+	udp, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close() })
+	connpkg := NewConnPacket(*raddr)
+	if _, err := connpkg.WriteTo(udp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Connection attempts exceeding the limits are refused.
+func TestListenLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ListenConfig
+		setup  func(t *testing.T, raddr *net.UDPAddr)
+	}{
+		{"MaxConns", ListenConfig{MaxConns: 1}, func(t *testing.T, raddr *net.UDPAddr) {
+			c, err := Dial("udp", nil, raddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { c.Close() })
+		}},
+		{"MaxHalfOpen", ListenConfig{MaxHalfOpen: 2}, func(t *testing.T, raddr *net.UDPAddr) {
+			dialRaw(t, raddr)
+			dialRaw(t, raddr)
+		}},
+		{"MaxConnsPerIP", ListenConfig{MaxConnsPerIP: 2}, func(t *testing.T, raddr *net.UDPAddr) {
+			dialRaw(t, raddr)
+			c, err := Dial("udp", nil, raddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { c.Close() })
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.SendCloseOnRefuse = true
+			listener, err := tt.config.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback, Port: 0})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			raddr := listener.Addr().(*net.UDPAddr)
+			tt.setup(t, raddr)
+
+			start := time.Now()
+			if c, err := Dial("udp", nil, raddr); err == nil {
+				c.Close()
+				t.Fatal("connection over the limit was accepted")
+			}
+			if time.Since(start) > connTimeout/2 {
+				t.Errorf("refusal took %v, expected close packet", time.Since(start))
+			}
+		})
+	}
+}
+
+// Closed connections don't count towards the limits.
+func TestListenLimitsClose(t *testing.T) {
+	lc := ListenConfig{MaxConns: 1, SendCloseOnRefuse: true}
+	listener, err := lc.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback, Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	raddr := listener.Addr().(*net.UDPAddr)
+
+	c1, err := Dial("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, err := listener.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.Close()
+	if _, err := s1.Read(nil); err == nil {
+		t.Fatal("expected connection to close")
+	}
+
+	c2, err := Dial("udp", nil, raddr)
+	if err != nil {
+		t.Fatalf("connection after close was refused: %v", err)
+	}
+	c2.Close()
+}
+
+// Listeners in cookie mode only accept connections acknowledging the cookie.
+func TestCookies(t *testing.T) {
+	lc := ListenConfig{Cookies: true}
+	listener, err := lc.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback, Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	raddr := listener.Addr().(*net.UDPAddr)
+	accepted := make(chan *Conn, 1)
+	go func() {
+		for {
+			conn, err := listener.AcceptConn()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// Raw handshake with a wrong and the right acknowledgement.
+	udp, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	connpkg := NewConnPacket(*raddr)
+	if _, err := connpkg.WriteTo(udp); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	udp.SetReadDeadline(time.Now().Add(1 * time.Second))
+	n, err := udp.Read(buf)
+	if err != nil {
+		t.Fatalf("no ConnPacket reply: %v", err)
+	}
+	connpkt, err := ReadConnPacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := connpkt.Nr
+	check := NewCheckPacketHdr(nil, cookie+1, 0)
+	check.WriteTo(udp)
+	select {
+	case <-accepted:
+		t.Fatal("accepted connection with invalid cookie")
+	case <-time.After(100 * time.Millisecond):
+	}
+	check = NewCheckPacketHdr(nil, cookie, 0)
+	check.WriteTo(udp)
+	select {
+	case <-accepted:
+	case <-time.After(1 * time.Second):
+		t.Fatal("connection with valid cookie not accepted")
+	}
+
+	// Regular connections work in both directions.
+	c, err := Dial("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var s *Conn
+	select {
+	case s = <-accepted:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for accept")
+	}
+	for _, w := range []struct{ from, to *Conn }{{c, s}, {s, c}} {
+		if _, err := w.from.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 16)
+		n, err := w.to.Read(b)
+		if err != nil || string(b[:n]) != "hello" {
+			t.Errorf("Read() = %q, %v", b[:n], err)
+		}
+	}
+}
+
+// A peer reconnecting in cookie mode without closing its old connection, e.g.
+// after a crash, replaces the old connection.
+func TestCookieReconnection(t *testing.T) {
+	lc := ListenConfig{Cookies: true}
+	listener, err := lc.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback, Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	raddr := listener.Addr().(*net.UDPAddr)
+	accepted := make(chan *Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.AcceptConn()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// The first connection vanishes without sending IPID_Close.
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback, Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := udp.LocalAddr().(*net.UDPAddr)
+	connpkg := NewConnPacket(*raddr)
+	if _, err := connpkg.WriteTo(writerToUDP{udp, raddr}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	udp.SetReadDeadline(time.Now().Add(1 * time.Second))
+	n, err := udp.Read(buf)
+	if err != nil {
+		t.Fatalf("no ConnPacket reply: %v", err)
+	}
+	connpkt, err := ReadConnPacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := NewCheckPacketHdr(nil, connpkt.Nr, 0)
+	check.WriteTo(writerToUDP{udp, raddr})
+	var s1 *Conn
+	select {
+	case s1 = <-accepted:
+	case <-time.After(1 * time.Second):
+		t.Fatal("first connection not accepted")
+	}
+	udp.Close()
+
+	// The restarted peer connects from the same address within the same
+	// cookie slot.
+	c, err := Dial("udp", laddr, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var s2 *Conn
+	select {
+	case s2 = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reconnection not accepted")
+	}
+	if _, err := s1.Read(nil); err == nil {
+		t.Error("old connection still open")
+	}
+	for _, w := range []struct{ from, to *Conn }{{c, s2}, {s2, c}} {
+		if _, err := w.from.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 16)
+		w.to.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := w.to.Read(b)
+		if err != nil || string(b[:n]) != "hello" {
+			t.Errorf("Read() = %q, %v", b[:n], err)
+		}
+	}
+}
+
+func TestCookieExpiry(t *testing.T) {
+	j, err := newCookieJar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 11112}
+	now := time.Now()
+	c := j.cookie(addr, 0, now)
+	if !j.valid(addr, 0, c, now) || !j.valid(addr, 0, c, now.Add(cookieSlot)) {
+		t.Error("recent cookie invalid")
+	}
+	if j.valid(addr, 0, c, now.Add(2*cookieSlot)) {
+		t.Error("old cookie valid")
+	}
+	if j.valid(&net.UDPAddr{IP: addr.IP, Port: 11113}, 0, c, now) {
+		t.Error("cookie valid for different address")
+	}
+	if j.cookie(addr, c, now) == c || j.valid(addr, c, c, now) {
+		t.Error("reconnection got the same cookie")
+	}
+}
+
+// Messages arrive complete and in order over a lossy network, through a NAT.
+func TestSimnet(t *testing.T) {
+	config := simnet.Config{Seed: 1, Latency: 2 * time.Millisecond, Jitter: 5 * time.Millisecond, MTU: MaxSize}
+	n := simnet.New(config)
+	serverAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 11115}
+	pc, err := n.ListenPacket(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ListenPacket(pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	nat := n.NewNAT(net.IPv4(198, 51, 100, 1), simnet.PortRestrictedCone)
+	pc, err = nat.ListenPacket(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 11112})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ListenPacket(pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	a, err := client.Dial(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := server.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := b.RemoteAddr().(*net.UDPAddr); !addr.IP.Equal(net.IPv4(198, 51, 100, 1)) {
+		t.Errorf("connection from %v, expected the NAT's address", addr)
+	}
+	if addr := a.ExternalAddr(); addr.String() != b.RemoteAddr().String() {
+		t.Errorf("ExternalAddr() = %v, server sees %v", addr, b.RemoteAddr())
+	}
+	if addr := b.ExternalAddr(); addr != nil {
+		t.Errorf("ExternalAddr() = %v for accepted connection", addr)
+	}
+
+	config.Loss = 0.2
+	config.Duplicate = 0.1
+	n.SetConfig(config)
+	rng := rand.New(rand.NewSource(1))
+	msgs := randomMessages(rng, 50)
+	go func() {
+		for _, msg := range msgs {
+			if _, err := a.Write(msg); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	b.SetReadDeadline(time.Now().Add(20 * time.Second))
+	for i, msg := range msgs {
+		got, err := b.ReadMessage()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("message %d differs", i)
+		}
+	}
+}
+
+// Plain UDP packets reach UnhandledPacket, and WriteTo sends them.
+func TestUnhandledPacket(t *testing.T) {
+	n := simnet.New(simnet.Config{})
+	laddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 11115}
+	pc, err := n.ListenPacket(laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type packet struct {
+		addr string
+		data string
+	}
+	unhandled := make(chan packet, 1)
+	lc := ListenConfig{UnhandledPacket: func(addr *net.UDPAddr, b []byte) {
+		unhandled <- packet{addr.String(), string(b)}
+	}}
+	listener, err := lc.ListenPacket(pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	raw, err := n.ListenPacket(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 11112})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	raw.WriteToUDP([]byte("plain message"), laddr)
+	select {
+	case p := <-unhandled:
+		if p.addr != raw.LocalAddr().String() || p.data != "plain message" {
+			t.Errorf("UnhandledPacket(%s, %q)", p.addr, p.data)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("UnhandledPacket wasn't called")
+	}
+
+	if _, err := listener.WriteTo([]byte("reply"), raw.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	raw.SetReadDeadline(time.Now().Add(1 * time.Second))
+	buf := make([]byte, 100)
+	if n, addr, err := raw.ReadFromUDP(buf); err != nil || string(buf[:n]) != "reply" || addr.String() != laddr.String() {
+		t.Errorf("ReadFromUDP() = %q, %v, %v", buf[:n], addr, err)
+	}
+}
@@ -0,0 +1,156 @@
+package c4netioudp
+
+import "errors"
+
+// Limits for incoming data buffered until messages are complete
+const (
+	// Maximum number of bytes in incomplete messages. Larger messages can't
+	// be received.
+	maxReassemblyBytes = 4 * 1024 * 1024
+	// Fragments further ahead of the next expected one are dropped.
+	maxReassemblyAhead = 1 << 16
+)
+
+// Reasons for dropping fragments
+var (
+	errFragmentRange    = errors.New("c4netioudp: fragment number out of range")
+	errFragmentMismatch = errors.New("c4netioudp: fragment doesn't match its message")
+	errMessageTooLarge  = errors.New("c4netioudp: incoming message too large")
+	errReassemblyFull   = errors.New("c4netioudp: reassembly buffer full")
+)
+
+// recvPacket is an incomplete message.
+type recvPacket struct {
+	fragments    map[uint32][]byte
+	size         uint32 // combined size of fragments
+	completeSize uint32
+}
+
+// reassembler puts the fragments of incoming messages back together and
+// delivers the messages in order. It doesn't trust the peer: Each fragment
+// has to fit the FNr and Size of its message, fragment numbers can't belong
+// to two messages, and the buffered data is limited. Bad fragments are
+// dropped, the peer has to send them again if it wants to make progress.
+type reassembler struct {
+	next     uint32                 // FNr of the next message to deliver
+	packets  map[uint32]*recvPacket // incomplete messages by FNr
+	owner    map[uint32]uint32      // FNr of the message each buffered fragment belongs to
+	buffered int                    // bytes in incomplete messages
+	maxBytes int
+}
+
+func newReassembler(next uint32) *reassembler {
+	return &reassembler{
+		next:     next,
+		packets:  make(map[uint32]*recvPacket),
+		owner:    make(map[uint32]uint32),
+		maxBytes: maxReassemblyBytes,
+	}
+}
+
+// add stores the fragment nr of the message starting at fnr with the given
+// total size. It returns an error if the fragment was dropped. Duplicates of
+// fragments we already have are ignored silently.
+func (r *reassembler) add(nr, fnr, size uint32, data []byte) error {
+	if seqLess(nr, r.next) {
+		return nil // already delivered
+	}
+	if !seqInRange(nr, r.next, maxReassemblyAhead) {
+		return errFragmentRange
+	}
+	if seqLess(fnr, r.next) || seqLess(nr, fnr) {
+		return errFragmentRange
+	}
+	if size > uint32(r.maxBytes) {
+		return errMessageTooLarge
+	}
+	// Every fragment carries at least one byte, except for the only
+	// fragment of an empty message.
+	if size == 0 {
+		if nr != fnr || len(data) != 0 {
+			return errFragmentMismatch
+		}
+	} else if len(data) == 0 || nr-fnr >= size || uint32(len(data)) > size {
+		return errFragmentMismatch
+	}
+	if owner, ok := r.owner[nr]; ok {
+		if owner != fnr {
+			return errFragmentMismatch
+		}
+		return nil // retransmitted duplicate
+	}
+	pkt := r.packets[fnr]
+	if pkt != nil && pkt.completeSize != size {
+		return errFragmentMismatch
+	}
+	if pkt != nil && pkt.size+uint32(len(data)) > size {
+		return errFragmentMismatch
+	}
+	// Always accept data for the next message so that we make progress.
+	if fnr != r.next && r.buffered+len(data) > r.maxBytes {
+		return errReassemblyFull
+	}
+	if pkt == nil {
+		pkt = &recvPacket{
+			fragments:    make(map[uint32][]byte),
+			completeSize: size,
+		}
+		r.packets[fnr] = pkt
+	}
+	pkt.fragments[nr] = data
+	pkt.size += uint32(len(data))
+	r.owner[nr] = fnr
+	r.buffered += len(data)
+	return nil
+}
+
+// pop returns the next message if it is complete.
+func (r *reassembler) pop() ([]byte, bool) {
+	pkt := r.packets[r.next]
+	if pkt == nil || pkt.size < pkt.completeSize {
+		return nil, false
+	}
+	buf := make([]byte, 0, pkt.size)
+	nr := r.next
+	for uint32(len(buf)) < pkt.size || len(buf) == 0 && nr == r.next {
+		fragment, ok := pkt.fragments[nr]
+		if !ok {
+			// The fragments add up to the message size, but there's a
+			// gap. The peer fragments differently than it claims.
+			r.drop(r.next)
+			return nil, false
+		}
+		buf = append(buf, fragment...)
+		nr++
+	}
+	if uint32(len(pkt.fragments)) != nr-r.next {
+		// More fragments than the message needs.
+		r.drop(r.next)
+		return nil, false
+	}
+	r.drop(r.next)
+	r.next = nr
+	return buf, true
+}
+
+// drop forgets the message starting at fnr.
+func (r *reassembler) drop(fnr uint32) {
+	pkt := r.packets[fnr]
+	for nr := range pkt.fragments {
+		delete(r.owner, nr)
+	}
+	r.buffered -= int(pkt.size)
+	delete(r.packets, fnr)
+}
+
+// missing returns up to max fragment numbers before end which we didn't
+// receive yet.
+func (r *reassembler) missing(end uint32, max int) []uint32 {
+	var asks []uint32
+	for nr := r.next; seqLess(nr, end) && seqInRange(nr, r.next, maxReassemblyAhead) && len(asks) < max; nr++ {
+		if _, ok := r.owner[nr]; !ok {
+			asks = append(asks, nr)
+		}
+	}
+	return asks
+}
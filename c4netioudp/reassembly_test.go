@@ -0,0 +1,171 @@
+package c4netioudp
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+type fragment struct {
+	nr, fnr, size uint32
+	data          []byte
+}
+
+// fragmentMessages splits msgs into fragments like Conn.Write, starting with
+// fragment number nr.
+func fragmentMessages(nr uint32, msgs [][]byte) []fragment {
+	var frags []fragment
+	for _, msg := range msgs {
+		fnr := nr
+		for i := 0; i < FragmentCnt(len(msg)); i++ {
+			high := (i + 1) * MaxDataSize
+			if high > len(msg) {
+				high = len(msg)
+			}
+			frags = append(frags, fragment{nr, fnr, uint32(len(msg)), msg[i*MaxDataSize : high]})
+			nr++
+		}
+	}
+	return frags
+}
+
+func randomMessages(rng *rand.Rand, n int) [][]byte {
+	msgs := make([][]byte, n)
+	for i := range msgs {
+		msgs[i] = make([]byte, rng.Intn(4*MaxDataSize))
+		rng.Read(msgs[i])
+	}
+	return msgs
+}
+
+// checkBuffered verifies the bookkeeping of r.
+func checkBuffered(t *testing.T, r *reassembler) {
+	t.Helper()
+	total, frags := 0, 0
+	for _, pkt := range r.packets {
+		size := 0
+		for _, data := range pkt.fragments {
+			size += len(data)
+		}
+		if uint32(size) != pkt.size || pkt.size > pkt.completeSize {
+			t.Fatalf("message has %d bytes, expected %d of %d", size, pkt.size, pkt.completeSize)
+		}
+		total += size
+		frags += len(pkt.fragments)
+	}
+	if total != r.buffered || frags != len(r.owner) {
+		t.Fatalf("%d bytes in %d fragments buffered, bookkeeping says %d in %d", total, frags, r.buffered, len(r.owner))
+	}
+	if r.buffered > 2*r.maxBytes {
+		t.Fatalf("%d bytes buffered", r.buffered)
+	}
+}
+
+// Fragments arriving in any order and any number of times result in the
+// original messages.
+func TestReassemblyReorder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, start := range []uint32{0, math.MaxUint32 - 20, math.MaxInt32 - 3, rng.Uint32()} {
+		for round := 0; round < 50; round++ {
+			msgs := randomMessages(rng, 1+rng.Intn(10))
+			frags := fragmentMessages(start, msgs)
+			// Duplicate some fragments and shuffle everything.
+			for i := rng.Intn(len(frags)); i > 0; i-- {
+				frags = append(frags, frags[rng.Intn(len(frags))])
+			}
+			rng.Shuffle(len(frags), func(i, j int) { frags[i], frags[j] = frags[j], frags[i] })
+
+			r := newReassembler(start)
+			var got [][]byte
+			for _, f := range frags {
+				if err := r.add(f.nr, f.fnr, f.size, f.data); err != nil {
+					t.Fatalf("add(%d, %d, %d): %v", f.nr, f.fnr, f.size, err)
+				}
+				checkBuffered(t, r)
+				for {
+					msg, ok := r.pop()
+					if !ok {
+						break
+					}
+					got = append(got, msg)
+				}
+			}
+			if len(got) != len(msgs) {
+				t.Fatalf("got %d messages, expected %d", len(got), len(msgs))
+			}
+			for i := range msgs {
+				if !bytes.Equal(got[i], msgs[i]) {
+					t.Fatalf("message %d differs", i)
+				}
+			}
+			if r.next != start+uint32(len(fragmentMessages(start, msgs))) || r.buffered != 0 {
+				t.Errorf("next = %d, buffered = %d after all messages", r.next, r.buffered)
+			}
+		}
+	}
+}
+
+// Garbage fragments never crash the reassembler or grow its buffer beyond
+// the limit.
+func TestReassemblyGarbage(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	r := newReassembler(1000)
+	r.maxBytes = 64 * 1024
+	near := func(base uint32) uint32 {
+		return base + uint32(rng.Intn(200)) - 100
+	}
+	for i := 0; i < 20000; i++ {
+		f := fragment{nr: near(r.next), fnr: near(r.next), size: uint32(rng.Intn(8 * MaxDataSize))}
+		switch rng.Intn(4) {
+		case 0:
+			f.nr = rng.Uint32()
+		case 1:
+			f.size = rng.Uint32()
+		case 2:
+			f.fnr = f.nr - uint32(rng.Intn(3))
+		}
+		f.data = make([]byte, rng.Intn(MaxDataSize+1))
+		r.add(f.nr, f.fnr, f.size, f.data)
+		for {
+			if _, ok := r.pop(); !ok {
+				break
+			}
+		}
+		checkBuffered(t, r)
+	}
+}
+
+// Retransmitted fragments must not complete a message early.
+func TestReassemblyDuplicate(t *testing.T) {
+	msg := bytes.Repeat([]byte("x"), 3*MaxDataSize)
+	frags := fragmentMessages(5, [][]byte{msg})
+	r := newReassembler(5)
+	for i := 0; i < 3; i++ {
+		r.add(frags[0].nr, frags[0].fnr, frags[0].size, frags[0].data)
+		r.add(frags[2].nr, frags[2].fnr, frags[2].size, frags[2].data)
+	}
+	if _, ok := r.pop(); ok {
+		t.Fatal("delivered incomplete message")
+	}
+	// Fragments not matching the message header are dropped.
+	bad := []fragment{
+		{6, 5, frags[1].size + 1, frags[1].data},                                  // wrong size
+		{6, 5, frags[1].size, append(append([]byte(nil), frags[1].data...), 'y')}, // too much data
+		{6, 7, frags[1].size, frags[1].data},                                      // FNr after Nr
+		{6, 4, frags[1].size, frags[1].data},                                      // FNr before the next message
+		{6, 5, frags[1].size, nil},                                                // empty fragment
+	}
+	for _, f := range bad {
+		if err := r.add(f.nr, f.fnr, f.size, f.data); err == nil {
+			t.Errorf("add(%d, %d, %d, %d bytes) accepted bad fragment", f.nr, f.fnr, f.size, len(f.data))
+		}
+	}
+	r.add(frags[1].nr, frags[1].fnr, frags[1].size, frags[1].data)
+	if got, ok := r.pop(); !ok || !bytes.Equal(got, msg) {
+		t.Fatalf("pop() = %d bytes, %v", len(got), ok)
+	}
+	if asks := r.missing(r.next+3, maxAsks); len(asks) != 3 || asks[0] != r.next {
+		t.Errorf("missing() = %v", asks)
+	}
+}
@@ -0,0 +1,60 @@
+package c4netioudp
+
+import "time"
+
+// Retransmission timeout bounds
+const (
+	initialRTO = 1 * time.Second
+	minRTO     = 200 * time.Millisecond
+	maxRTO     = 10 * time.Second
+)
+
+// Time we wait before acknowledging received data with a Check packet. This
+// lets us acknowledge multiple fragments at once.
+const ackDelay = 10 * time.Millisecond
+
+// rttEstimator computes the retransmission timeout from round-trip time
+// samples as described in RFC 6298.
+type rttEstimator struct {
+	srtt, rttvar time.Duration
+	rto          time.Duration
+	hasSample    bool
+}
+
+func newRTTEstimator() rttEstimator {
+	return rttEstimator{rto: initialRTO}
+}
+
+// sample updates the estimate with a new round-trip time measurement. Callers
+// must not take samples from retransmitted packets (Karn's algorithm).
+func (e *rttEstimator) sample(rtt time.Duration) {
+	if !e.hasSample {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.hasSample = true
+	} else {
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		// alpha = 1/8, beta = 1/4
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+	e.setRTO(e.srtt + 4*e.rttvar)
+}
+
+// backoff doubles the timeout after it expired.
+func (e *rttEstimator) backoff() {
+	e.setRTO(2 * e.rto)
+}
+
+func (e *rttEstimator) setRTO(rto time.Duration) {
+	if rto < minRTO {
+		rto = minRTO
+	}
+	if rto > maxRTO {
+		rto = maxRTO
+	}
+	e.rto = rto
+}
@@ -0,0 +1,32 @@
+package c4netioudp
+
+// Sequence numbers
+//
+// Packet numbers are uint32 and wrap around on long-lived connections. We
+// compare them with serial number arithmetic as in RFC 1982: a is before b if
+// the distance from a to b is less than half the number space. This is fine as
+// long as all packet numbers in flight are close to each other, which the
+// send window and the reassembly limits ensure.
+
+// seqLess reports whether a comes before b.
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// seqLessEq reports whether a comes before b or equals it.
+func seqLessEq(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+// seqMax returns the later of a and b.
+func seqMax(a, b uint32) uint32 {
+	if seqLess(a, b) {
+		return b
+	}
+	return a
+}
+
+// seqInRange reports whether nr is in the n numbers starting at first.
+func seqInRange(nr, first uint32, n int) bool {
+	return nr-first < uint32(n)
+}
@@ -0,0 +1,81 @@
+package c4netioudp
+
+import (
+	"bytes"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSeqArithmetic(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		less bool
+	}{
+		{0, 1, true},
+		{1, 0, false},
+		{5, 5, false},
+		{math.MaxUint32, 0, true},
+		{math.MaxUint32 - 10, 10, true},
+		{10, math.MaxUint32 - 10, false},
+		{math.MaxInt32, math.MaxInt32 + 1, true},
+	}
+	for _, tt := range tests {
+		if got := seqLess(tt.a, tt.b); got != tt.less {
+			t.Errorf("seqLess(%d, %d) = %v", tt.a, tt.b, got)
+		}
+		if got := seqLessEq(tt.a, tt.b); got != (tt.less || tt.a == tt.b) {
+			t.Errorf("seqLessEq(%d, %d) = %v", tt.a, tt.b, got)
+		}
+	}
+	if m := seqMax(math.MaxUint32, 2); m != 2 {
+		t.Errorf("seqMax(MaxUint32, 2) = %d", m)
+	}
+	if !seqInRange(1, math.MaxUint32, 3) || seqInRange(2, math.MaxUint32, 3) || seqInRange(math.MaxUint32-1, math.MaxUint32, 3) {
+		t.Error("seqInRange() is wrong around the wraparound")
+	}
+}
+
+// Connections keep working when packet numbers wrap around, even with lost
+// and retransmitted fragments.
+func TestWraparound(t *testing.T) {
+	start := uint32(math.MaxUint32 - 20)
+	a, b := pipeConnsAt(t, start, randomLoss(1, 0.1), randomLoss(2, 0.1))
+
+	msgs := make([][]byte, 20)
+	for i := range msgs {
+		msgs[i] = bytes.Repeat([]byte{byte(i)}, 3*MaxDataSize)
+	}
+	go func() {
+		for _, msg := range msgs {
+			if _, err := a.Write(msg); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i, msg := range msgs {
+		if got := readTimeout(t, b, 10*time.Second); !bytes.Equal(got, msg) {
+			t.Fatalf("message %d differs", i)
+		}
+	}
+	if n := atomic.LoadUint32(&a.oPacketCounter); n != start+60 || !seqLess(start, n) {
+		t.Fatalf("oPacketCounter = %d, expected wraparound", n)
+	}
+
+	// Everything gets acknowledged.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.window.mu.Lock()
+		packets := a.window.packets
+		a.window.mu.Unlock()
+		if packets == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d fragments still unacknowledged", packets)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
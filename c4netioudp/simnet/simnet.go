@@ -0,0 +1,531 @@
+// Package simnet is an in-memory UDP network for testing c4netioudp and the
+// netpuncher. It simulates packet loss, duplication, latency with jitter
+// (which reorders packets), a maximum packet size and NATs of the common
+// mapping and filtering types.
+//
+// All random decisions come from a single RNG seeded with Config.Seed. The
+// sequence of decisions only depends on the order in which packets are sent,
+// so a test exchanging packets in lockstep sees the same losses every run.
+//
+//	n := simnet.New(simnet.Config{Seed: 1, Loss: 0.1})
+//	server, _ := n.ListenPacket(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 11115})
+//	nat := n.NewNAT(net.IPv4(198, 51, 100, 1), simnet.PortRestrictedCone)
+//	client, _ := nat.ListenPacket(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 11112})
+package simnet
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Number of packets queued for a socket before further packets are lost.
+const queueSize = 256
+
+var (
+	// Returned by PacketConn methods after Close.
+	ErrClosed = errors.New("simnet: use of closed connection")
+	// Returned when binding an address which is already in use.
+	ErrAddrInUse = errors.New("simnet: address already in use")
+)
+
+// Returned by ReadFromUDP when the read deadline passed.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "simnet: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Config describes the behavior of all links in a Network.
+type Config struct {
+	Seed      int64         // seed for all random decisions
+	Loss      float64       // probability of losing a packet
+	Duplicate float64       // probability of delivering a packet twice
+	Latency   time.Duration // one-way delay of every packet
+	Jitter    time.Duration // random additional delay up to this value
+	MTU       int           // larger packets are lost, zero means no limit
+}
+
+// Network connects PacketConns and NATs.
+type Network struct {
+	config Config
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	socks map[string]*PacketConn // sockets with public addresses
+	nats  map[string]*NAT        // NATs by public IP
+	ports map[string]int         // next port for automatic binding, by IP
+
+	pending deliveryQueue // delayed packets
+	seq     uint64        // sequence number of the next delayed packet
+	running bool          // deliverPending is running
+	wake    chan struct{} // tells deliverPending about new packets
+}
+
+// New creates an empty network.
+func New(config Config) *Network {
+	return &Network{
+		config: config,
+		rng:    rand.New(rand.NewSource(config.Seed)),
+		socks:  make(map[string]*PacketConn),
+		nats:   make(map[string]*NAT),
+		ports:  make(map[string]int),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// SetConfig changes the behavior of all links, for example to add packet
+// loss after connections were established. Packets already underway aren't
+// affected. The RNG continues with its current state, config.Seed is ignored.
+func (n *Network) SetConfig(config Config) {
+	n.mu.Lock()
+	config.Seed = n.config.Seed
+	n.config = config
+	n.mu.Unlock()
+}
+
+// ListenPacket creates a socket with the public address laddr. Port 0 picks
+// a free port.
+func (n *Network) ListenPacket(laddr *net.UDPAddr) (*PacketConn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.nats[laddr.IP.String()]; ok {
+		return nil, ErrAddrInUse
+	}
+	addr := n.bind(laddr, func(key string) bool {
+		_, ok := n.socks[key]
+		return ok
+	})
+	if addr == nil {
+		return nil, ErrAddrInUse
+	}
+	c := newPacketConn(n, addr)
+	n.socks[addr.String()] = c
+	return c, nil
+}
+
+// bind picks the address for a new socket. Returns nil if the address is
+// taken. n.mu must be held.
+func (n *Network) bind(laddr *net.UDPAddr, taken func(key string) bool) *net.UDPAddr {
+	addr := &net.UDPAddr{IP: laddr.IP, Port: laddr.Port}
+	if addr.Port != 0 {
+		if taken(addr.String()) {
+			return nil
+		}
+		return addr
+	}
+	ip := laddr.IP.String()
+	for i := 0; i < 65535-49152; i++ {
+		port := n.ports[ip]
+		if port < 49152 {
+			port = 49152
+		}
+		n.ports[ip] = port + 1
+		if n.ports[ip] > 65535 {
+			n.ports[ip] = 49152
+		}
+		addr.Port = port
+		if !taken(addr.String()) {
+			return addr
+		}
+	}
+	return nil
+}
+
+// NewNAT adds a NAT with the given public IP to the network.
+func (n *Network) NewNAT(public net.IP, typ NATType) *NAT {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	nat := &NAT{
+		net:      n,
+		public:   public,
+		typ:      typ,
+		socks:    make(map[string]*PacketConn),
+		mappings: make(map[string]*mapping),
+		ports:    make(map[int]*mapping),
+	}
+	n.nats[public.String()] = nat
+	return nat
+}
+
+// send transmits a packet from the public address src.
+func (n *Network) send(src *net.UDPAddr, dst *net.UDPAddr, b []byte) {
+	n.mu.Lock()
+	if n.config.MTU > 0 && len(b) > n.config.MTU || n.rng.Float64() < n.config.Loss {
+		n.mu.Unlock()
+		return
+	}
+	copies := 1
+	if n.rng.Float64() < n.config.Duplicate {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = n.config.Latency
+		if n.config.Jitter > 0 {
+			delays[i] += time.Duration(n.rng.Int63n(int64(n.config.Jitter)))
+		}
+	}
+	n.mu.Unlock()
+
+	pkt := packet{append([]byte(nil), b...), &net.UDPAddr{IP: src.IP, Port: src.Port}}
+	for _, d := range delays {
+		if d == 0 {
+			n.deliver(dst, pkt)
+			continue
+		}
+		n.schedule(&delivery{at: time.Now().Add(d), dst: dst, pkt: pkt})
+	}
+}
+
+// schedule queues a delayed packet. Packets with the same delivery time
+// arrive in the order they were sent.
+func (n *Network) schedule(d *delivery) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	d.seq = n.seq
+	n.seq++
+	heap.Push(&n.pending, d)
+	if !n.running {
+		n.running = true
+		go n.deliverPending()
+		return
+	}
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverPending delivers queued packets when they are due. It exits when
+// the queue is empty.
+func (n *Network) deliverPending() {
+	for {
+		n.mu.Lock()
+		if len(n.pending) == 0 {
+			n.running = false
+			n.mu.Unlock()
+			return
+		}
+		next := n.pending[0]
+		wait := time.Until(next.at)
+		if wait <= 0 {
+			heap.Pop(&n.pending)
+			n.mu.Unlock()
+			n.deliver(next.dst, next.pkt)
+			continue
+		}
+		n.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-n.wake:
+			// An earlier packet may have been scheduled.
+			timer.Stop()
+		}
+	}
+}
+
+// deliver hands a packet to the socket or NAT at dst.
+func (n *Network) deliver(dst *net.UDPAddr, pkt packet) {
+	n.mu.Lock()
+	sock := n.socks[dst.String()]
+	nat := n.nats[dst.IP.String()]
+	n.mu.Unlock()
+	if sock != nil {
+		sock.enqueue(pkt)
+	} else if nat != nil {
+		nat.inbound(dst.Port, pkt)
+	}
+}
+
+// NATType selects the mapping and filtering behavior of a NAT, using the
+// classic names from RFC 3489.
+type NATType int
+
+const (
+	// Endpoint-independent mapping and filtering: Anybody can send to a
+	// mapped port.
+	FullCone NATType = iota
+	// Endpoint-independent mapping, incoming packets are only accepted
+	// from IPs the socket sent packets to.
+	RestrictedCone
+	// Endpoint-independent mapping, incoming packets are only accepted
+	// from addresses the socket sent packets to.
+	PortRestrictedCone
+	// Every destination gets its own mapping, which only accepts packets
+	// from that destination. The peer of a hole punch sees a different
+	// port than the netpuncher.
+	Symmetric
+)
+
+func (t NATType) String() string {
+	switch t {
+	case FullCone:
+		return "full cone"
+	case RestrictedCone:
+		return "restricted cone"
+	case PortRestrictedCone:
+		return "port restricted cone"
+	case Symmetric:
+		return "symmetric"
+	}
+	return fmt.Sprintf("NATType(%d)", int(t))
+}
+
+// NAT translates between private sockets and its public IP. Mappings never
+// expire. Sockets behind a NAT can't reach each other by private address,
+// and the NAT doesn't support hairpinning.
+type NAT struct {
+	net    *Network
+	public net.IP
+	typ    NATType
+
+	mu       sync.Mutex
+	socks    map[string]*PacketConn // by private address
+	mappings map[string]*mapping    // by private address and, for symmetric NATs, destination
+	ports    map[int]*mapping       // by public port
+	nextPort int
+}
+
+// mapping is a public port of a NAT.
+type mapping struct {
+	sock   *PacketConn
+	public *net.UDPAddr
+	peers  map[string]bool // addresses or IPs the socket sent packets to
+}
+
+// ListenPacket creates a socket with the private address laddr behind the
+// NAT. Port 0 picks a free port.
+func (nat *NAT) ListenPacket(laddr *net.UDPAddr) (*PacketConn, error) {
+	nat.net.mu.Lock()
+	defer nat.net.mu.Unlock()
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+	addr := nat.net.bind(laddr, func(key string) bool {
+		_, ok := nat.socks[key]
+		return ok
+	})
+	if addr == nil {
+		return nil, ErrAddrInUse
+	}
+	c := newPacketConn(nat.net, addr)
+	c.nat = nat
+	nat.socks[addr.String()] = c
+	return c, nil
+}
+
+// Type returns the type of the NAT.
+func (nat *NAT) Type() NATType {
+	return nat.typ
+}
+
+// peerKey returns the key for filtering packets from addr.
+func (nat *NAT) peerKey(addr *net.UDPAddr) string {
+	switch nat.typ {
+	case FullCone:
+		return ""
+	case RestrictedCone:
+		return addr.IP.String()
+	}
+	return addr.String()
+}
+
+// outbound returns the public address for a packet from sock to dst.
+func (nat *NAT) outbound(sock *PacketConn, dst *net.UDPAddr) *net.UDPAddr {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+	key := sock.laddr.String()
+	if nat.typ == Symmetric {
+		key += "->" + dst.String()
+	}
+	m := nat.mappings[key]
+	if m == nil {
+		// Allocate public ports in order, starting with the private port
+		// if it is free, like many home routers do.
+		port := sock.laddr.Port
+		for nat.ports[port] != nil {
+			if nat.nextPort < 1024 {
+				nat.nextPort = 1024
+			}
+			port = nat.nextPort
+			nat.nextPort++
+		}
+		m = &mapping{
+			sock:   sock,
+			public: &net.UDPAddr{IP: nat.public, Port: port},
+			peers:  make(map[string]bool),
+		}
+		nat.mappings[key] = m
+		nat.ports[port] = m
+	}
+	m.peers[nat.peerKey(dst)] = true
+	return m.public
+}
+
+// inbound delivers a packet arriving at the public port to the mapped socket
+// if the filter lets it through.
+func (nat *NAT) inbound(port int, pkt packet) {
+	nat.mu.Lock()
+	m := nat.ports[port]
+	ok := m != nil && m.peers[nat.peerKey(pkt.addr)]
+	nat.mu.Unlock()
+	if ok {
+		m.sock.enqueue(pkt)
+	}
+}
+
+// remove forgets the socket and its mappings.
+func (nat *NAT) remove(sock *PacketConn) {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+	delete(nat.socks, sock.laddr.String())
+	for key, m := range nat.mappings {
+		if m.sock == sock {
+			delete(nat.mappings, key)
+			delete(nat.ports, m.public.Port)
+		}
+	}
+}
+
+type packet struct {
+	data []byte
+	addr *net.UDPAddr // source
+}
+
+// delivery is a delayed packet.
+type delivery struct {
+	at  time.Time
+	seq uint64
+	dst *net.UDPAddr
+	pkt packet
+}
+
+// deliveryQueue is a heap of deliveries ordered by time and sequence number.
+type deliveryQueue []*delivery
+
+func (q deliveryQueue) Len() int { return len(q) }
+func (q deliveryQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q deliveryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *deliveryQueue) Push(x interface{}) { *q = append(*q, x.(*delivery)) }
+func (q *deliveryQueue) Pop() interface{} {
+	old := *q
+	d := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return d
+}
+
+// PacketConn is a UDP socket on a Network. It implements
+// c4netioudp.PacketConn.
+type PacketConn struct {
+	net   *Network
+	nat   *NAT // nil for public sockets
+	laddr *net.UDPAddr
+
+	queue     chan packet
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time // read deadline
+}
+
+func newPacketConn(n *Network, laddr *net.UDPAddr) *PacketConn {
+	return &PacketConn{
+		net:    n,
+		laddr:  laddr,
+		queue:  make(chan packet, queueSize),
+		closed: make(chan struct{}),
+	}
+}
+
+// enqueue receives a packet. Packets are lost if the queue is full.
+func (c *PacketConn) enqueue(pkt packet) {
+	select {
+	case <-c.closed:
+	case c.queue <- pkt:
+	default:
+	}
+}
+
+// ReadFromUDP reads the next packet. Packets larger than b are truncated.
+func (c *PacketConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case pkt := <-c.queue:
+		return copy(b, pkt.data), pkt.addr, nil
+	case <-c.closed:
+		return 0, nil, ErrClosed
+	case <-timeout:
+		return 0, nil, timeoutError{}
+	}
+}
+
+// SetReadDeadline sets the deadline for ReadFromUDP calls started afterwards.
+// The zero value disables the deadline.
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// WriteToUDP sends a packet to addr, which has to be a public address.
+func (c *PacketConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, ErrClosed
+	default:
+	}
+	src := c.laddr
+	if c.nat != nil {
+		src = c.nat.outbound(c, addr)
+	}
+	c.net.send(src, addr, b)
+	return len(b), nil
+}
+
+// Close removes the socket from the network. Blocked reads return ErrClosed.
+func (c *PacketConn) Close() error {
+	err := ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.nat != nil {
+			c.nat.remove(c)
+		} else {
+			c.net.mu.Lock()
+			delete(c.net.socks, c.laddr.String())
+			c.net.mu.Unlock()
+		}
+		err = nil
+	})
+	return err
+}
+
+// LocalAddr returns the address the socket is bound to. For sockets behind
+// a NAT, this is the private address.
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.laddr
+}
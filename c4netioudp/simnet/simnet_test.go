@@ -0,0 +1,183 @@
+package simnet
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	serverAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 11115}
+	otherAddr  = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 11116}
+	thirdAddr  = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 11115}
+	natIP      = net.IPv4(198, 51, 100, 1)
+	privAddr   = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 11112}
+)
+
+func listen(t *testing.T, n *Network, addr *net.UDPAddr) *PacketConn {
+	t.Helper()
+	c, err := n.ListenPacket(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// read returns the next packet or nil if nothing arrives within a short time.
+func read(c *PacketConn) (string, *net.UDPAddr) {
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, 1500)
+	n, addr, err := c.ReadFromUDP(buf)
+	if err != nil {
+		return "", nil
+	}
+	return string(buf[:n]), addr
+}
+
+// received sends n numbered packets and returns the numbers of the ones that
+// arrived.
+func received(config Config, n int) string {
+	net := New(config)
+	a, _ := net.ListenPacket(serverAddr)
+	b, _ := net.ListenPacket(otherAddr)
+	defer a.Close()
+	defer b.Close()
+	for i := 0; i < n; i++ {
+		a.WriteToUDP([]byte{byte(i)}, otherAddr)
+	}
+	var got []byte
+	for len(b.queue) > 0 {
+		got = append(got, (<-b.queue).data...)
+	}
+	return string(got)
+}
+
+func TestLossDeterministic(t *testing.T) {
+	config := Config{Seed: 42, Loss: 0.3}
+	first := received(config, 100)
+	if len(first) < 50 || len(first) > 90 {
+		t.Errorf("received %d of 100 packets with 30%% loss", len(first))
+	}
+	for i := 0; i < 5; i++ {
+		if again := received(config, 100); again != first {
+			t.Fatalf("different losses with the same seed: %x vs %x", again, first)
+		}
+	}
+	config.Duplicate = 0.5
+	if dup := received(config, 100); len(dup) <= len(first) {
+		t.Errorf("received %d packets with duplication, %d without", len(dup), len(first))
+	}
+}
+
+func TestMTU(t *testing.T) {
+	n := New(Config{MTU: 100})
+	a := listen(t, n, serverAddr)
+	b := listen(t, n, otherAddr)
+	a.WriteToUDP(make([]byte, 101), otherAddr)
+	a.WriteToUDP([]byte("small"), otherAddr)
+	if data, addr := read(b); data != "small" || addr.String() != serverAddr.String() {
+		t.Errorf("read() = %q from %v", data, addr)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	n := New(Config{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	a := listen(t, n, serverAddr)
+	b := listen(t, n, otherAddr)
+	start := time.Now()
+	a.WriteToUDP([]byte("x"), otherAddr)
+	if data, _ := read(b); data != "x" {
+		t.Fatal("packet lost")
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("packet arrived after %v", d)
+	}
+
+	// Without jitter, packets arrive in order.
+	n.SetConfig(Config{Latency: 10 * time.Millisecond})
+	for i := 0; i < 100; i++ {
+		a.WriteToUDP([]byte{byte(i)}, otherAddr)
+	}
+	for i := 0; i < 100; i++ {
+		if data, _ := read(b); data != string([]byte{byte(i)}) {
+			t.Fatalf("packet %d: got %x", i, data)
+		}
+	}
+}
+
+func TestNAT(t *testing.T) {
+	for _, test := range []struct {
+		typ NATType
+		// whether packets arrive at the mapped port from a different port
+		// and from a different IP
+		otherPort, otherIP bool
+	}{
+		{FullCone, true, true},
+		{RestrictedCone, true, false},
+		{PortRestrictedCone, false, false},
+		{Symmetric, false, false},
+	} {
+		t.Run(test.typ.String(), func(t *testing.T) {
+			n := New(Config{})
+			server := listen(t, n, serverAddr)
+			other := listen(t, n, otherAddr)
+			third := listen(t, n, thirdAddr)
+			nat := n.NewNAT(natIP, test.typ)
+			client, err := nat.ListenPacket(privAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			// Nothing gets through before the client sent something.
+			server.WriteToUDP([]byte("unsolicited"), &net.UDPAddr{IP: natIP, Port: privAddr.Port})
+			client.WriteToUDP([]byte("hello"), serverAddr)
+			data, mapped := read(server)
+			if data != "hello" || !mapped.IP.Equal(natIP) {
+				t.Fatalf("read() = %q from %v", data, mapped)
+			}
+			server.WriteToUDP([]byte("reply"), mapped)
+			if data, addr := read(client); data != "reply" || addr.String() != serverAddr.String() {
+				t.Fatalf("reply: read() = %q from %v", data, addr)
+			}
+			for _, from := range []struct {
+				c  *PacketConn
+				ok bool
+			}{{other, test.otherPort}, {third, test.otherIP}} {
+				from.c.WriteToUDP([]byte("other"), mapped)
+				if data, _ := read(client); (data == "other") != from.ok {
+					t.Errorf("packet from %v: received = %v", from.c.LocalAddr(), !from.ok)
+				}
+			}
+
+			// The mapping for another destination has the same port unless
+			// the NAT is symmetric.
+			client.WriteToUDP([]byte("hello"), otherAddr)
+			_, mapped2 := read(other)
+			if (mapped2.Port == mapped.Port) == (test.typ == Symmetric) {
+				t.Errorf("mapped to %v for %v and %v for %v", mapped, serverAddr, mapped2, otherAddr)
+			}
+		})
+	}
+}
+
+func TestAddrInUse(t *testing.T) {
+	n := New(Config{})
+	a := listen(t, n, serverAddr)
+	if _, err := n.ListenPacket(serverAddr); err != ErrAddrInUse {
+		t.Errorf("ListenPacket() on used address: %v", err)
+	}
+	a.Close()
+	listen(t, n, serverAddr)
+	ports := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		c := listen(t, n, &net.UDPAddr{IP: serverAddr.IP})
+		addr := fmt.Sprint(c.LocalAddr())
+		if ports[addr] {
+			t.Errorf("port %s allocated twice", addr)
+		}
+		ports[addr] = true
+	}
+}
@@ -0,0 +1,183 @@
+package c4netioudp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// Unreliable messages
+//
+// C4NetIOUDP has no unacknowledged data packets: The high bit of the status
+// byte marks multicast packets, and all IPID_Data packets are retransmitted.
+// We carry unreliable messages in IPID_Test packets, which C4NetIOUDP
+// discards silently. OpenClonk peers thus ignore them instead of mixing them
+// into the reliable stream.
+//
+// The packet number stays zero, as C4NetIOUDP tracks the highest packet number
+// of all packets to ask for missing data. Instead, a separate sequence number
+// follows the header. Receivers drop messages older than the newest one they
+// delivered, so that a late game state update doesn't overwrite a newer one.
+//
+// OpenClonk peers may send test packets of their own, so both sides announce
+// support first: A packet with sequence number zero, followed by
+// unreliableMagic and flags, is an announcement. Conns send it when the
+// connection starts and repeat it with the Check packets until the peer
+// confirms it with unreliableSeen. Only after receiving the peer's
+// announcement, a Conn sends and delivers unreliable messages.
+
+// Size of the header of unreliable messages: PacketHdr and sequence number.
+const UnreliablePacketHdrSize = PacketHdrSize + 4
+
+// Maximum size of an unreliable message. Unreliable messages aren't
+// fragmented.
+const MaxUnreliableSize = MaxSize - UnreliablePacketHdrSize
+
+// Returned by WriteUnreliable for messages larger than MaxUnreliableSize.
+var ErrUnreliableTooLarge = errors.New("c4netioudp: unreliable message too large")
+
+// Returned by WriteUnreliable if the peer didn't announce support for
+// unreliable messages (yet).
+var ErrUnreliableNotSupported = errors.New("c4netioudp: peer doesn't support unreliable messages")
+
+// Announcements of support for unreliable messages
+const (
+	unreliableMagic     = 0x52553443 // "C4UR"
+	unreliableSeen      = 1          // flag: the sender received the peer's announcement
+	unreliableHelloSize = UnreliablePacketHdrSize + 8
+	// Announcements sent to peers which don't answer, like OpenClonk
+	maxUnreliableHellos = 10
+)
+
+type UnreliablePacketHdr struct {
+	PacketHdr
+	Seq uint32 // sequence number of unreliable messages
+}
+
+func NewUnreliablePacketHdr(seq uint32) UnreliablePacketHdr {
+	return UnreliablePacketHdr{
+		PacketHdr: PacketHdr{StatusByte: IPID_Test},
+		Seq:       seq,
+	}
+}
+
+func ReadUnreliablePacketHdr(b []byte) (pkg UnreliablePacketHdr, err error) {
+	if err = checkSize(b, UnreliablePacketHdrSize, "UnreliablePacketHdr"); err != nil {
+		return
+	}
+	pkg.PacketHdr, _ = ReadPacketHdr(b)
+	pkg.Seq = binary.LittleEndian.Uint32(b[PacketHdrSize:])
+	return
+}
+
+func (pkg *UnreliablePacketHdr) WriteTo(w io.Writer) (n int64, err error) {
+	var buf bytes.Buffer
+	buf.Grow(UnreliablePacketHdrSize)
+	pkg.PacketHdr.WriteTo(&buf)
+	binary.Write(&buf, binary.LittleEndian, pkg.Seq)
+	if buf.Len() != UnreliablePacketHdrSize {
+		panic("UnreliablePacketHdr has invalid size")
+	}
+	return buf.WriteTo(w)
+}
+
+// unreliableHello announces support for unreliable messages.
+type unreliableHello struct {
+	UnreliablePacketHdr
+	seen bool // the sender received the peer's announcement
+}
+
+func newUnreliableHello(seen bool) unreliableHello {
+	return unreliableHello{NewUnreliablePacketHdr(0), seen}
+}
+
+// readUnreliableHello decodes an announcement. Other packets with sequence
+// number zero aren't from a Conn.
+func readUnreliableHello(b []byte) (hello unreliableHello, ok bool) {
+	if len(b) < unreliableHelloSize || binary.LittleEndian.Uint32(b[UnreliablePacketHdrSize:]) != unreliableMagic {
+		return hello, false
+	}
+	hello.UnreliablePacketHdr, _ = ReadUnreliablePacketHdr(b)
+	hello.seen = binary.LittleEndian.Uint32(b[UnreliablePacketHdrSize+4:])&unreliableSeen != 0
+	return hello, true
+}
+
+func (hello *unreliableHello) WriteTo(w io.Writer) (n int64, err error) {
+	var buf bytes.Buffer
+	buf.Grow(unreliableHelloSize)
+	hello.UnreliablePacketHdr.WriteTo(&buf)
+	var flags uint32
+	if hello.seen {
+		flags |= unreliableSeen
+	}
+	binary.Write(&buf, binary.LittleEndian, uint32(unreliableMagic))
+	binary.Write(&buf, binary.LittleEndian, flags)
+	return buf.WriteTo(w)
+}
+
+// UnreliableSupported returns whether the peer announced support for
+// unreliable messages. The announcement arrives shortly after connecting,
+// OpenClonk peers never send it.
+func (c *Conn) UnreliableSupported() bool {
+	return atomic.LoadInt32(&c.uPeer) != 0
+}
+
+// WriteUnreliable sends b as a single packet without retransmissions. The
+// peer may receive it out of order or not at all. b must not be larger than
+// MaxUnreliableSize. Fails with ErrUnreliableNotSupported unless
+// UnreliableSupported. Like Write, it waits for congestion control.
+func (c *Conn) WriteUnreliable(b []byte) (n int, err error) {
+	select {
+	case <-c.quit:
+		return 0, ErrConnectionClosed(c.closereason)
+	default:
+	}
+	deadline := c.wdeadline.wait()
+	if isClosed(deadline) {
+		return 0, timeoutError{}
+	}
+	if len(b) > MaxUnreliableSize {
+		return 0, ErrUnreliableTooLarge
+	}
+	if !c.UnreliableSupported() {
+		return 0, ErrUnreliableNotSupported
+	}
+	if err := c.congestion.pace(true, c.quit, deadline); err != nil {
+		if err == errQuit {
+			err = ErrConnectionClosed(c.closereason)
+		}
+		return 0, err
+	}
+	seq := atomic.AddUint32(&c.uPacketCounter, 1)
+	if seq == 0 {
+		// Zero is reserved for announcements.
+		seq = atomic.AddUint32(&c.uPacketCounter, 1)
+	}
+	hdr := NewUnreliablePacketHdr(seq)
+	var buf bytes.Buffer
+	hdr.WriteTo(&buf)
+	buf.Write(b)
+	if _, err := buf.WriteTo(c.writer); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadUnreliable returns the next message sent with WriteUnreliable. Messages
+// which arrive while nobody reads them are dropped once a small queue is full.
+func (c *Conn) ReadUnreliable() ([]byte, error) {
+	deadline := c.rdeadline.wait()
+	if isClosed(deadline) {
+		return nil, timeoutError{}
+	}
+	select {
+	case data := <-c.unreliablechan:
+		return data, nil
+	case <-c.quit:
+		return nil, ErrConnectionClosed(c.closereason)
+	case <-deadline:
+		return nil, timeoutError{}
+	}
+}
@@ -0,0 +1,113 @@
+package c4netioudp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func dropUnreliable(b []byte) bool {
+	return b[0] == IPID_Test
+}
+
+// waitUnreliable waits until c received the peer's announcement.
+func waitUnreliable(t *testing.T, c *Conn) {
+	t.Helper()
+	for i := 0; !c.UnreliableSupported(); i++ {
+		if i == 100 {
+			t.Fatal("peer didn't announce unreliable messages")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUnreliable(t *testing.T) {
+	a, b := pipeConns(t, nil, nil)
+	waitUnreliable(t, a)
+	waitUnreliable(t, b)
+	b.SetReadDeadline(time.Now().Add(1 * time.Second))
+
+	if _, err := a.WriteUnreliable([]byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Write([]byte("reliable")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := b.ReadUnreliable(); err != nil || string(msg) != "one" {
+		t.Errorf("ReadUnreliable() = %q, %v", msg, err)
+	}
+	if msg, err := b.ReadMessage(); err != nil || string(msg) != "reliable" {
+		t.Errorf("ReadMessage() = %q, %v", msg, err)
+	}
+
+	// Lost messages are gone.
+	a.writer.(*pipeWriter).setDrop(dropUnreliable)
+	if _, err := a.WriteUnreliable([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	a.writer.(*pipeWriter).setDrop(nil)
+	if _, err := a.WriteUnreliable([]byte("three")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := b.ReadUnreliable(); err != nil || string(msg) != "three" {
+		t.Errorf("ReadUnreliable() = %q, %v", msg, err)
+	}
+
+	// Late messages are dropped.
+	var buf bytes.Buffer
+	hdr := NewUnreliablePacketHdr(2)
+	hdr.WriteTo(&buf)
+	buf.WriteString("late")
+	a.writer.Write(buf.Bytes())
+	// Plain test packets are ignored as well.
+	test := PacketHdr{StatusByte: IPID_Test}
+	test.WriteTo(a.writer)
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if msg, err := b.ReadUnreliable(); !isTimeout(err) {
+		t.Errorf("ReadUnreliable() = %q, %v, expected timeout", msg, err)
+	}
+
+	if _, err := a.WriteUnreliable(make([]byte, MaxUnreliableSize+1)); err != ErrUnreliableTooLarge {
+		t.Errorf("WriteUnreliable() of large message: %v", err)
+	}
+}
+
+// dropHello loses announcements of unreliable messages.
+func dropHello(b []byte) bool {
+	_, ok := readUnreliableHello(b)
+	return ok
+}
+
+// Without the peer's announcement, test packets aren't unreliable messages,
+// as OpenClonk uses them for other things.
+func TestUnreliableNegotiation(t *testing.T) {
+	a, b := pipeConns(t, dropHello, nil)
+	waitUnreliable(t, a)
+	if b.UnreliableSupported() {
+		t.Fatal("b got a's announcement")
+	}
+	if _, err := b.WriteUnreliable([]byte("hello")); err != ErrUnreliableNotSupported {
+		t.Errorf("WriteUnreliable() without announcement: %v", err)
+	}
+
+	// A test packet of an OpenClonk peer which looks like a message
+	var buf bytes.Buffer
+	hdr := NewUnreliablePacketHdr(1)
+	hdr.WriteTo(&buf)
+	buf.WriteString("test")
+	a.writer.Write(buf.Bytes())
+	// a knows that b supports unreliable messages, but b doesn't know
+	// about a.
+	if _, err := a.WriteUnreliable([]byte("dropped")); err != nil {
+		t.Fatal(err)
+	}
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if msg, err := b.ReadUnreliable(); !isTimeout(err) {
+		t.Errorf("ReadUnreliable() = %q, %v, expected timeout", msg, err)
+	}
+
+	// Announcements are repeated until the peer confirms them.
+	a.writer.(*pipeWriter).setDrop(nil)
+	time.Sleep(checkInterval + 100*time.Millisecond)
+	waitUnreliable(t, b)
+}
@@ -10,8 +10,18 @@ type rfu struct {
 	err  error
 }
 
+// PacketConn is the UDP socket of a Listener or Conn. *net.UDPConn implements
+// it, package simnet provides an in-memory network for tests.
+type PacketConn interface {
+	// ReadFromUDP reads a single packet. It returns an error after Close.
+	ReadFromUDP(b []byte) (n int, addr *net.UDPAddr, err error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	Close() error
+	LocalAddr() net.Addr
+}
+
 // udp.ReadFromUDP for goroutine use
-func readFromUDP(udp *net.UDPConn, rfuchan chan<- rfu, quit <-chan bool) {
+func readFromUDP(udp PacketConn, rfuchan chan<- rfu, quit <-chan bool) {
 	for {
 		var r rfu
 		r.buf = make([]byte, 1500)
@@ -25,7 +35,7 @@ func readFromUDP(udp *net.UDPConn, rfuchan chan<- rfu, quit <-chan bool) {
 }
 
 type writerToUDP struct {
-	udp  *net.UDPConn
+	udp  PacketConn
 	addr *net.UDPAddr
 }
 
@@ -0,0 +1,98 @@
+package c4netioudp
+
+import (
+	"errors"
+	"sync"
+)
+
+// Default limits for unacknowledged data, see Conn.SetSendWindow
+const (
+	DefaultSendWindowBytes   = 256 * 1024
+	DefaultSendWindowPackets = 512
+)
+
+// Returned by sendWindow.acquire when the connection closes while waiting.
+var errQuit = errors.New("c4netioudp: connection closed while waiting")
+
+// sendWindow limits the amount of data sent but not yet acknowledged by the
+// peer. Write takes space in the window and handlePackets releases it when
+// Check packets acknowledge the data.
+type sendWindow struct {
+	mu         sync.Mutex
+	maxBytes   int
+	maxPackets int
+	bytes      int           // unacknowledged bytes
+	packets    int           // unacknowledged fragments
+	wake       chan struct{} // signals waiting writers
+}
+
+func newSendWindow() *sendWindow {
+	return &sendWindow{
+		maxBytes:   DefaultSendWindowBytes,
+		maxPackets: DefaultSendWindowPackets,
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+func (w *sendWindow) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// fits reports whether a message can be sent. Messages larger than the window
+// can be sent once everything else was acknowledged. The caller must hold
+// w.mu.
+func (w *sendWindow) fits(bytes, packets int) bool {
+	if w.packets == 0 {
+		return true
+	}
+	return (w.maxBytes <= 0 || w.bytes+bytes <= w.maxBytes) &&
+		(w.maxPackets <= 0 || w.packets+packets <= w.maxPackets)
+}
+
+// acquire waits until the message fits into the window and takes its space.
+// It gives up when the connection closes or the deadline channel is closed.
+func (w *sendWindow) acquire(bytes, packets int, quit <-chan bool, deadline <-chan struct{}) error {
+	w.mu.Lock()
+	for !w.fits(bytes, packets) {
+		w.mu.Unlock()
+		select {
+		case <-w.wake:
+		case <-deadline:
+			return timeoutError{}
+		case <-quit:
+			return errQuit
+		}
+		w.mu.Lock()
+	}
+	w.bytes += bytes
+	w.packets += packets
+	// Pass the wakeup on to other writers if there is space left.
+	if w.fits(1, 1) {
+		w.signal()
+	}
+	w.mu.Unlock()
+	return nil
+}
+
+// release frees the space of acknowledged data.
+func (w *sendWindow) release(bytes, packets int) {
+	w.mu.Lock()
+	w.bytes -= bytes
+	w.packets -= packets
+	w.mu.Unlock()
+	w.signal()
+}
+
+// SetSendWindow limits the data Write sends before the peer acknowledges it.
+// Once the limit is reached, Write blocks until enough data is acknowledged or
+// the write deadline expires. Values <= 0 disable a limit.
+func (c *Conn) SetSendWindow(bytes, packets int) {
+	c.window.mu.Lock()
+	c.window.maxBytes = bytes
+	c.window.maxPackets = packets
+	c.window.mu.Unlock()
+	c.window.signal()
+}
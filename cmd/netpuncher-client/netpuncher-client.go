@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"net"
@@ -11,6 +13,7 @@ import (
 
 	"github.com/openclonk/netpuncher"
 	"github.com/openclonk/netpuncher/c4netioudp"
+	"github.com/openclonk/netpuncher/natprobe"
 
 	"github.com/apex/log"
 	"github.com/apex/log/handlers/cli"
@@ -27,6 +30,11 @@ var port = flag.Int("port", 0, "local port to use (default: random)")
 var v4 = flag.Bool("4", false, "use IPv4")
 var v6 = flag.Bool("6", false, "use IPv6")
 var verbose = flag.Bool("v", false, "more log output")
+var auth = flag.Bool("auth", false, "as host, require clients to present a join token")
+var token = flag.String("token", "", "as client, join token (hex) for the host")
+var resume = flag.String("resume", "", "resume token (hex) from a previous host session")
+var protocolVersion = flag.Int("protocol", int(netpuncher.NewestProtocolVersion), "netpuncher protocol version to use")
+var natProbe = flag.Bool("nat-probe", false, "find out the NAT type and exit")
 
 func main() {
 	flag.Usage = func() {
@@ -61,24 +69,45 @@ func main() {
 		ip = net.IPv4zero
 	}
 	laddr := net.UDPAddr{IP: ip, Port: *port}
-	listener, err := c4netioudp.Listen(network, &laddr)
+	var lc c4netioudp.ListenConfig
+	prober := natprobe.New()
+	if *natProbe {
+		lc.UnhandledPacket = prober.HandlePacket
+	}
+	listener, err := lc.Listen(network, &laddr)
 	if err != nil {
 		log.WithError(err).Fatal("c4netioudp Listen failed")
 	}
 	defer listener.Close()
 
+	if *natProbe {
+		probeNAT(prober, listener, raddr)
+		return
+	}
+
 	conn, err := listener.Dial(raddr)
 	if err != nil {
 		log.WithError(err).Fatal("c4netioudp Dial failed")
 	}
 	defer conn.Close()
 
-	// The following uses version 1 of the netpuncher protocol.
-	header := netpuncher.Header{Version: 1}
+	header := netpuncher.Header{Version: netpuncher.ProtocolVersion(*protocolVersion)}
+	if !header.Version.Supported() {
+		log.Fatalf("unsupported protocol version %d", *protocolVersion)
+	}
 
 	if *client >= 0 {
 		// Request punching for the given host id.
-		sreq := netpuncher.SReq{Header: header, CID: uint32(*client)}
+		if *token != "" {
+			header.Caps |= netpuncher.CapAuth
+		}
+		var jointoken netpuncher.JoinToken
+		t, err := hex.DecodeString(*token)
+		if err != nil || (len(t) != 0 && len(t) != len(jointoken)) {
+			log.Fatalf("invalid join token %q", *token)
+		}
+		copy(jointoken[:], t)
+		sreq := netpuncher.SReq{Header: header, CID: uint32(*client), Token: jointoken}
 		b, err := sreq.MarshalBinary()
 		if err != nil {
 			log.WithError(err).Fatal("SReq.MarshalBinary failed")
@@ -88,7 +117,7 @@ func main() {
 		go handleMessages(listener, conn, false)
 		if *v6 {
 			// IPv6 => also request TCP punching
-			sreqtcp := netpuncher.SReqTCP{Header: header, CID: uint32(*client)}
+			sreqtcp := netpuncher.SReqTCP{Header: header, CID: uint32(*client), Token: jointoken}
 			b, err = sreqtcp.MarshalBinary()
 			if err != nil {
 				log.WithError(err).Fatal("SReqTCP.MarshalBinary failed")
@@ -101,7 +130,21 @@ func main() {
 
 	if *host {
 		// Request an ID.
-		b, err := netpuncher.IDReq{Header: header}.MarshalBinary()
+		idreq := netpuncher.IDReq{Header: header}
+		if header.Version >= 2 {
+			idreq.Header.Caps |= netpuncher.CapResume
+		}
+		if *auth {
+			idreq.Header.Caps |= netpuncher.CapAuth
+		}
+		if *resume != "" {
+			token, err := hex.DecodeString(*resume)
+			if err != nil || len(token) != len(idreq.ResumeToken) {
+				log.Fatalf("invalid resume token %q", *resume)
+			}
+			copy(idreq.ResumeToken[:], token)
+		}
+		b, err := idreq.MarshalBinary()
 		if err != nil {
 			panic(err)
 		}
@@ -116,6 +159,35 @@ func main() {
 	}
 }
 
+// Classify the NAT and tell whether hosting should work.
+func probeNAT(prober *natprobe.Prober, listener *c4netioudp.Listener, raddr *net.UDPAddr) {
+	result, err := prober.Probe(context.Background(), listener, raddr)
+	if err != nil {
+		log.WithError(err).Fatal("NAT probe failed")
+	}
+	log.WithFields(log.Fields{
+		"local":        result.Local,
+		"mapped":       result.Mapped,
+		"probe":        result.ProbeAddr,
+		"probe mapped": result.ProbeMapped,
+		"unsolicited":  result.Unsolicited,
+	}).Debug("NAT probe")
+	fmt.Printf("NAT type:  %s\n", result)
+	fmt.Printf("mapping:   %s\n", result.Mapping())
+	fmt.Printf("filtering: %s\n", result.Filtering())
+	fmt.Printf("public address: %v\n", result.Mapped)
+	switch {
+	case result.ProbeAddr == nil:
+		fmt.Println("The netpuncher has no secondary address, the NAT type is unknown.")
+	case result.Mapping() == natprobe.MappingEndpointDependent:
+		fmt.Println("Hole punching won't work. Forward a port on your router to host games.")
+	case result.Mapping() == natprobe.MappingNone && result.Unsolicited:
+		fmt.Println("Other players can connect directly.")
+	default:
+		fmt.Println("Hole punching should work.")
+	}
+}
+
 // Handle and print incoming messages.
 func handleMessages(listener *c4netioudp.Listener, npconn *c4netioudp.Conn, isHost bool) {
 	for {
@@ -126,6 +198,18 @@ func handleMessages(listener *c4netioudp.Listener, npconn *c4netioudp.Conn, isHo
 		switch np := msg.(type) {
 		case *netpuncher.AssID:
 			log.Warnf("CID = %d", np.CID)
+			if np.Addr.Port != 0 {
+				log.Infof("public address = %v", &np.Addr)
+			}
+			if !np.ResumeToken.IsZero() {
+				log.Infof("resume token = %x", np.ResumeToken[:])
+			}
+			if np.Caps.Has(netpuncher.CapAuth) {
+				jointoken := netpuncher.NewJoinToken(np.Secret, np.CID)
+				log.Infof("join token = %x", jointoken[:])
+			}
+		case *netpuncher.NAck:
+			log.WithField("packet", fmt.Sprintf("%+v", msg)).Errorf("request 0x%x for #%d rejected: %s", np.Request, np.CID, np.Reason)
 		case *netpuncher.CReq:
 			log.WithField("packet", fmt.Sprintf("%+v", msg)).Infof("<- %T", msg)
 			go func() {
@@ -194,13 +278,12 @@ func handleConn(listener *c4netioudp.Listener) {
 		go func(conn *c4netioudp.Conn) {
 			defer conn.Close()
 			log.WithField("raddr", conn.RemoteAddr().String()).Info("new connection")
-			var buf [100]byte
-			n, err := conn.Read(buf[:])
+			msg, err := conn.ReadMessage()
 			if err != nil {
 				log.WithError(err).Error("error while reading")
 				return
 			}
-			log.WithField("raddr", conn.RemoteAddr().String()).Infof("received: %s", string(buf[0:n]))
+			log.WithField("raddr", conn.RemoteAddr().String()).Infof("received: %s", string(msg))
 		}(conn)
 	}
 }
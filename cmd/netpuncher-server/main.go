@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/openclonk/netpuncher"
 	"github.com/openclonk/netpuncher/c4netioudp"
@@ -16,6 +19,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Time to wait for connections to close on shutdown
+const shutdownTimeout = 5 * time.Second
+
 var (
 	connectionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "netpuncher_connections_total",
@@ -37,6 +43,14 @@ var (
 		Name: "netpuncher_errors_total",
 		Help: "Number of non-fatal errors during packet handling",
 	}, []string{"protocol", "reason"})
+	rateLimitCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "netpuncher_ratelimited_total",
+		Help: "Number of connections and punch requests dropped by rate limits",
+	}, []string{"protocol", "limit"})
+	natProbeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "netpuncher_nat_probes_total",
+		Help: "Number of NAT probes answered by the netpuncher",
+	}, []string{"protocol"})
 )
 
 func init() {
@@ -45,6 +59,8 @@ func init() {
 	prometheus.MustRegister(hostCounter)
 	prometheus.MustRegister(creqCounter)
 	prometheus.MustRegister(errorCounter)
+	prometheus.MustRegister(rateLimitCounter)
+	prometheus.MustRegister(natProbeCounter)
 }
 
 func protocol(addr net.Addr) string {
@@ -58,12 +74,73 @@ func protocol(addr net.Addr) string {
 	return "unknown"
 }
 
+// rateLimitFromEnv parses a rate limit of the form "rate/burst" from the
+// environment variable with the given name. Unset variables disable the limit.
+func rateLimitFromEnv(name string) server.RateLimit {
+	v := os.Getenv(name)
+	if v == "" {
+		return server.RateLimit{}
+	}
+	parts := strings.SplitN(v, "/", 2)
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		log.Fatalf("%s: invalid rate %q", name, parts[0])
+	}
+	limit := server.RateLimit{Rate: rate, Burst: 1}
+	if len(parts) == 2 {
+		if limit.Burst, err = strconv.Atoi(parts[1]); err != nil {
+			log.Fatalf("%s: invalid burst %q", name, parts[1])
+		}
+	}
+	return limit
+}
+
+// intFromEnv parses an integer from the environment variable with the given
+// name. Unset variables return 0.
+func intFromEnv(name string) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("%s: invalid number %q", name, v)
+	}
+	return n
+}
+
 func main() {
 	listenaddr := net.UDPAddr{IP: net.IPv6unspecified, Port: 11115}
 	if p, err := strconv.Atoi(os.Getenv("PORT")); err == nil {
 		listenaddr.Port = p
 	}
 
+	var leaseDuration time.Duration
+	if d, err := time.ParseDuration(os.Getenv("LEASE_DURATION")); err == nil {
+		leaseDuration = d
+	}
+
+	// Instances share their hosts over TCP links to the given peers.
+	var registry server.Registry
+	if addr := os.Getenv("PEER_ADDR"); addr != "" {
+		peers := server.NewPeerRegistry()
+		if err := peers.Listen("tcp", addr); err != nil {
+			log.Fatal("couldn't listen for peers: ", err)
+		}
+		log.Printf("peer link listening on %v", peers.Addr())
+		for _, peer := range strings.Split(os.Getenv("PEERS"), ",") {
+			if peer == "" {
+				continue
+			}
+			if err := peers.Connect("tcp", peer); err != nil {
+				// The peer will connect to us when it starts.
+				log.Printf("couldn't connect to peer %s: %v", peer, err)
+			}
+		}
+		defer peers.Close()
+		registry = peers
+	}
+
 	server := server.Server{
 		AcceptConn: func(c *server.Conn, err error) {
 			if err != nil {
@@ -75,7 +152,7 @@ func main() {
 		},
 		MarshalErr: func(err error) {
 			log.Println(err)
-			errorCounter.With(prometheus.Labels{"reason": "marshal"}).Inc()
+			errorCounter.With(prometheus.Labels{"protocol": "unknown", "reason": "marshal"}).Inc()
 		},
 		UnsupportedVersionErr: func(c *server.Conn, err *netpuncher.ErrUnsupportedVersion) {
 			log.Printf("client #%d: unsupported version %d", c.ID, err)
@@ -89,6 +166,10 @@ func main() {
 			log.Printf("host: #%d", host.ID)
 			hostCounter.With(prometheus.Labels{"protocol": protocol(host.NetIOConn.RemoteAddr())}).Inc()
 		},
+		RegisterErr: func(host *server.Conn, err error) {
+			log.Printf("host #%d: couldn't register: %v", host.ID, err)
+			errorCounter.With(prometheus.Labels{"protocol": protocol(host.NetIOConn.RemoteAddr()), "reason": "register"}).Inc()
+		},
 		CReq: func(host *server.Conn, client *server.Conn) {
 			clientaddr := client.NetIOConn.RemoteAddr()
 			log.Printf("CReq: client %v <--> host %v #%d\n", clientaddr, host.NetIOConn.RemoteAddr(), host.ID)
@@ -97,24 +178,93 @@ func main() {
 			// anyways.
 			creqCounter.With(prometheus.Labels{"protocol": protocol(clientaddr)}).Inc()
 		},
+		ForwardCReq: func(host server.HostInfo, client *server.Conn) {
+			clientaddr := client.NetIOConn.RemoteAddr()
+			log.Printf("CReq: client %v <--> remote host %v #%d\n", clientaddr, host.Addr, host.ID)
+			creqCounter.With(prometheus.Labels{"protocol": protocol(clientaddr)}).Inc()
+		},
+		RemoteCReq: func(host *server.Conn, p server.Punch) {
+			log.Printf("CReq: remote client %v <--> host %v #%d\n", &p.ClientAddr, host.NetIOConn.RemoteAddr(), host.ID)
+		},
 		CloseConn: func(c *server.Conn, err *c4netioudp.ErrConnectionClosed) {
 			addr := c.NetIOConn.RemoteAddr()
 			log.Printf("close:   %v #%d (%s)\n", addr, c.ID, err)
 			disconnectCounter.With(prometheus.Labels{"protocol": protocol(addr)}).Inc()
 		},
+		AuthFailed: func(client *server.Conn, id uint32) {
+			clientaddr := client.NetIOConn.RemoteAddr()
+			log.Printf("auth failed: client %v --> host #%d", clientaddr, id)
+			errorCounter.With(prometheus.Labels{"protocol": protocol(clientaddr), "reason": "auth failed"}).Inc()
+		},
+		UnknownHost: func(client *server.Conn, id uint32) {
+			clientaddr := client.NetIOConn.RemoteAddr()
+			log.Printf("unknown host: client %v --> host #%d", clientaddr, id)
+			errorCounter.With(prometheus.Labels{"protocol": protocol(clientaddr), "reason": "unknown host"}).Inc()
+		},
+		RateLimited: func(addr net.Addr, limit server.Limit) {
+			log.Printf("rate limited: %v (%s)", addr, limit)
+			rateLimitCounter.With(prometheus.Labels{"protocol": protocol(addr), "limit": string(limit)}).Inc()
+		},
+		AllocErr: func(addr net.Addr, err error) {
+			log.Printf("couldn't allocate ID for %v: %v", addr, err)
+			errorCounter.With(prometheus.Labels{"protocol": protocol(addr), "reason": "id allocation"}).Inc()
+		},
+		ProbeErr: func(err error) {
+			log.Printf("error during Accept on probe listener: %v", err)
+			errorCounter.With(prometheus.Labels{"protocol": "unknown", "reason": "probe accept"}).Inc()
+		},
+		NATProbe: func(addr net.Addr) {
+			natProbeCounter.With(prometheus.Labels{"protocol": protocol(addr)}).Inc()
+		},
+		LeaseDuration: leaseDuration,
+		Registry:      registry,
+		ListenConfig: c4netioudp.ListenConfig{
+			MaxConns:          intFromEnv("MAX_CONNS"),
+			MaxHalfOpen:       intFromEnv("MAX_HALF_OPEN"),
+			MaxConnsPerIP:     intFromEnv("MAX_CONNS_PER_IP"),
+			SendCloseOnRefuse: true,
+			Cookies:           os.Getenv("HANDSHAKE_COOKIES") != "",
+			// Only count these, logging every packet would let attackers
+			// flood the log.
+			InvalidPacket: func(addr *net.UDPAddr, err error) {
+				errorCounter.With(prometheus.Labels{"protocol": protocol(addr), "reason": "malformed udp packet"}).Inc()
+			},
+		},
+		RateLimits: server.RateLimits{
+			ConnsPerIP:     rateLimitFromEnv("RATELIMIT_CONNS_PER_IP"),
+			Conns:          rateLimitFromEnv("RATELIMIT_CONNS"),
+			PunchesPerIP:   rateLimitFromEnv("RATELIMIT_PUNCHES_PER_IP"),
+			PunchesPerHost: rateLimitFromEnv("RATELIMIT_PUNCHES_PER_HOST"),
+			Punches:        rateLimitFromEnv("RATELIMIT_PUNCHES"),
+			ProbesPerIP:    rateLimitFromEnv("RATELIMIT_PROBES_PER_IP"),
+		},
+	}
+
+	// Secondary address for NAT probes, ideally on a different IP.
+	if addr := os.Getenv("PROBE_ADDR"); addr != "" {
+		probeaddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			log.Fatalf("PROBE_ADDR: invalid address %q", addr)
+		}
+		server.ProbeListener, err = server.ListenConfig.Listen("udp", probeaddr)
+		if err != nil {
+			log.Fatal("couldn't listen for NAT probes: ", err)
+		}
+		log.Printf("NAT probes on %v", server.ProbeListener.Addr())
 	}
 
 	err := server.Listen("udp", &listenaddr)
 	if err != nil {
 		log.Fatal("couldn't ListenUDP", err)
 	}
-	defer server.Close()
 	log.Printf("netpuncher listening on %v", server.Addr())
 
 	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
 		log.Printf("metrics listening on %s", addr)
 		http.Handle("/metrics", promhttp.Handler())
-		go log.Fatal(http.ListenAndServe(addr, nil))
+		go func() {
+			log.Fatal(http.ListenAndServe(addr, nil))
+		}()
 	}
 
 	// Wait for an interrupt. Without this special handling, the connection
@@ -122,4 +272,11 @@ func main() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
+
+	log.Println("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("shutdown:", err)
+	}
 }
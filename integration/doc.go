@@ -0,0 +1,4 @@
+// Package integration runs the netpuncher protocol flow end to end: A
+// server.Server, a host and a client, each on a simulated network from
+// c4netioudp/simnet, possibly behind NATs. The package only contains tests.
+package integration
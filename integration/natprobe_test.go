@@ -0,0 +1,98 @@
+package integration
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/openclonk/netpuncher/c4netioudp"
+	"github.com/openclonk/netpuncher/c4netioudp/simnet"
+	"github.com/openclonk/netpuncher/natprobe"
+	"github.com/openclonk/netpuncher/server"
+)
+
+// probe runs a NAT probe from pos against a netpuncher with a secondary
+// address probeAddr, which may be nil.
+func probe(t *testing.T, pos position, probeAddr *net.UDPAddr) *natprobe.Result {
+	// Without jitter, as reordered handshakes make probes take long.
+	n := simnet.New(simnet.Config{Seed: 1, Latency: 10 * time.Millisecond})
+	listen := func(addr *net.UDPAddr, lc c4netioudp.ListenConfig) *c4netioudp.Listener {
+		pc, err := n.ListenPacket(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := lc.ListenPacket(pc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return listener
+	}
+	s := &server.Server{}
+	if probeAddr != nil {
+		s.ProbeListener = listen(probeAddr, c4netioudp.ListenConfig{})
+	}
+	if err := s.Serve(listen(serverAddr, c4netioudp.ListenConfig{})); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	prober := natprobe.New()
+	prober.UnsolicitedWait = 200 * time.Millisecond
+	lc := c4netioudp.ListenConfig{UnhandledPacket: prober.HandlePacket}
+	laddr := &net.UDPAddr{IP: pos.ip, Port: 11112}
+	var pc *simnet.PacketConn
+	var err error
+	if pos.nat {
+		laddr.IP = net.IPv4(10, 0, 0, 2)
+		pc, err = n.NewNAT(pos.ip, pos.typ).ListenPacket(laddr)
+	} else {
+		pc, err = n.ListenPacket(laddr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := lc.ListenPacket(pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	result, err := prober.Probe(context.Background(), listener, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Mapped.IP.Equal(pos.ip) {
+		t.Errorf("mapped to %v, expected public IP %v", result.Mapped, pos.ip)
+	}
+	return result
+}
+
+// The NAT probe classifies every NAT correctly, as far as its secondary
+// address allows.
+func TestNATProbe(t *testing.T) {
+	otherIP := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 11116}
+	samePort := &net.UDPAddr{IP: serverAddr.IP, Port: 11116}
+	expected := map[string][2]string{ // results with otherIP and samePort
+		"public":               {"no NAT", "no NAT"},
+		"full cone":            {"full cone NAT", "full cone or restricted cone NAT"},
+		"restricted cone":      {"restricted cone or port restricted cone NAT", "full cone or restricted cone NAT"},
+		"port restricted cone": {"restricted cone or port restricted cone NAT", "port restricted cone NAT"},
+		"symmetric":            {"symmetric NAT", "symmetric NAT"},
+	}
+	for _, pos := range positions {
+		pos := pos
+		t.Run(pos.name, func(t *testing.T) {
+			t.Parallel()
+			for i, probeAddr := range []*net.UDPAddr{otherIP, samePort} {
+				if result := probe(t, pos, probeAddr); result.String() != expected[pos.name][i] {
+					t.Errorf("secondary address %v: %s (%+v), expected %s", probeAddr, result, result, expected[pos.name][i])
+				}
+			}
+			// Without secondary address, we only learn the public address.
+			result := probe(t, pos, nil)
+			if result.ProbeAddr != nil || pos.nat && result.Mapping() != natprobe.MappingUnknown {
+				t.Errorf("no secondary address: %+v", result)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package integration
+
+import (
+	"encoding"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/openclonk/netpuncher"
+	"github.com/openclonk/netpuncher/c4netioudp"
+	"github.com/openclonk/netpuncher/c4netioudp/simnet"
+	"github.com/openclonk/netpuncher/server"
+)
+
+const (
+	punchTimeout  = 1 * time.Second
+	punchInterval = 50 * time.Millisecond
+)
+
+var serverAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 11115}
+
+// Network position of a peer
+type position struct {
+	name  string
+	nat   bool // behind a NAT of type typ, or directly on the network
+	typ   simnet.NATType
+	ip    net.IP // public IP of the host, clients get the next one
+	punch bool   // punching works between two peers if both have this set
+}
+
+// Listener.Punch only accepts packets from the address the netpuncher saw.
+// Symmetric NATs use a different port towards the peer, so punching fails
+// with them until we implement port prediction.
+var positions = []position{
+	{name: "public", ip: net.IPv4(192, 0, 2, 10), punch: true},
+	{name: "full cone", nat: true, typ: simnet.FullCone, ip: net.IPv4(198, 51, 100, 10), punch: true},
+	{name: "restricted cone", nat: true, typ: simnet.RestrictedCone, ip: net.IPv4(198, 51, 100, 20), punch: true},
+	{name: "port restricted cone", nat: true, typ: simnet.PortRestrictedCone, ip: net.IPv4(198, 51, 100, 30), punch: true},
+	{name: "symmetric", nat: true, typ: simnet.Symmetric, ip: net.IPv4(198, 51, 100, 40), punch: false},
+}
+
+// peer is a host or client with a connection to the netpuncher.
+type peer struct {
+	listener *c4netioudp.Listener
+	conn     *c4netioudp.Conn
+}
+
+// publicIP returns the public IP of a host or client at pos.
+func publicIP(pos position, client bool) net.IP {
+	ip := append(net.IP(nil), pos.ip.To4()...)
+	if client {
+		ip[3]++
+	}
+	return ip
+}
+
+// newPeer creates a listener with the public IP ip at pos and connects to
+// the netpuncher.
+func newPeer(t *testing.T, n *simnet.Network, pos position, ip net.IP) *peer {
+	t.Helper()
+	var pc *simnet.PacketConn
+	var err error
+	if pos.nat {
+		nat := n.NewNAT(ip, pos.typ)
+		pc, err = nat.ListenPacket(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 11112})
+	} else {
+		pc, err = n.ListenPacket(&net.UDPAddr{IP: ip, Port: 11112})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &peer{}
+	if p.listener, err = c4netioudp.ListenPacket(pc); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.listener.Close() })
+	if p.conn, err = p.listener.Dial(serverAddr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.conn.Close() })
+	return p
+}
+
+func (p *peer) send(t *testing.T, msg encoding.BinaryMarshaler) {
+	t.Helper()
+	buf, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p *peer) receive(t *testing.T) netpuncher.PuncherPacket {
+	t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := netpuncher.ReadFrom(p.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// setup starts a netpuncher with a registered host and a connected client.
+// Returns the host's ID.
+func setup(t *testing.T, hostPos, clientPos position) (host, client *peer, id uint32) {
+	n := simnet.New(simnet.Config{Seed: 1, Latency: 10 * time.Millisecond, Jitter: 5 * time.Millisecond})
+	pc, err := n.ListenPacket(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := c4netioudp.ListenPacket(pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server.Server{}
+	if err := s.Serve(listener); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	host = newPeer(t, n, hostPos, publicIP(hostPos, false))
+	client = newPeer(t, n, clientPos, publicIP(clientPos, true))
+	host.send(t, netpuncher.IDReq{Header: netpuncher.Header{Version: 2}})
+	assid, ok := host.receive(t).(*netpuncher.AssID)
+	if !ok {
+		t.Fatal("expected AssID")
+	}
+	return host, client, assid.CID
+}
+
+// The UDP flow from messages.go for every combination of NATs.
+func TestPunchMatrix(t *testing.T) {
+	for _, hostPos := range positions {
+		for _, clientPos := range positions {
+			hostPos, clientPos := hostPos, clientPos
+			t.Run(fmt.Sprintf("host %s/client %s", hostPos.name, clientPos.name), func(t *testing.T) {
+				t.Parallel()
+				testPunch(t, hostPos, clientPos)
+			})
+		}
+	}
+}
+
+func testPunch(t *testing.T, hostPos, clientPos position) {
+	host, client, id := setup(t, hostPos, clientPos)
+	client.send(t, netpuncher.SReq{Header: netpuncher.Header{Version: 2}, CID: id})
+	hostCReq, ok := host.receive(t).(*netpuncher.CReq)
+	if !ok {
+		t.Fatal("host: expected CReq")
+	}
+	clientCReq, ok := client.receive(t).(*netpuncher.CReq)
+	if !ok {
+		t.Fatal("client: expected CReq")
+	}
+	if !hostCReq.Addr.IP.Equal(publicIP(clientPos, true)) || !clientCReq.Addr.IP.Equal(publicIP(hostPos, false)) {
+		t.Fatalf("host got %v, client got %v", &hostCReq.Addr, &clientCReq.Addr)
+	}
+
+	// Both sides punch at the same time, like netpuncher-client.
+	errch := make(chan error, 1)
+	go func() {
+		errch <- host.listener.Punch(&hostCReq.Addr, punchTimeout, punchInterval)
+	}()
+	clientErr := client.listener.Punch(&clientCReq.Addr, punchTimeout, punchInterval)
+	hostErr := <-errch
+	expected := hostPos.punch && clientPos.punch
+	if (hostErr == nil && clientErr == nil) != expected {
+		if expected {
+			t.Fatalf("punching failed: host: %v, client: %v", hostErr, clientErr)
+		}
+		// Good news, but the table in positions needs an update.
+		t.Fatalf("punching unexpectedly succeeded: host: %v, client: %v", hostErr, clientErr)
+	}
+	if !expected {
+		return
+	}
+
+	// The punched path carries a C4NetIOUDP connection.
+	conn, err := client.listener.Dial(&clientCReq.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	hostConn, err := host.listener.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hostConn.Close()
+	if _, err := conn.Write([]byte("Hello world!")); err != nil {
+		t.Fatal(err)
+	}
+	hostConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if msg, err := hostConn.ReadMessage(); err != nil || string(msg) != "Hello world!" {
+		t.Errorf("ReadMessage() = %q, %v", msg, err)
+	}
+}
+
+// The TCP flow from messages.go. simnet doesn't simulate TCP, so this only
+// checks that both sides get matching addresses for the simultaneous open.
+func TestPunchTCP(t *testing.T) {
+	hostPos, clientPos := positions[3], positions[1]
+	host, client, id := setup(t, hostPos, clientPos)
+	client.send(t, netpuncher.SReqTCP{Header: netpuncher.Header{Version: 2}, CID: id})
+	hostCReq, ok := host.receive(t).(*netpuncher.CReqTCP)
+	if !ok {
+		t.Fatal("host: expected CReqTCP")
+	}
+	clientCReq, ok := client.receive(t).(*netpuncher.CReqTCP)
+	if !ok {
+		t.Fatal("client: expected CReqTCP")
+	}
+	if hostCReq.SourceAddr.String() != clientCReq.DestAddr.String() || clientCReq.SourceAddr.String() != hostCReq.DestAddr.String() {
+		t.Errorf("host: %v -> %v, client: %v -> %v", &hostCReq.SourceAddr, &hostCReq.DestAddr, &clientCReq.SourceAddr, &clientCReq.DestAddr)
+	}
+	if !hostCReq.SourceAddr.IP.Equal(publicIP(hostPos, false)) || !clientCReq.SourceAddr.IP.Equal(publicIP(clientPos, true)) {
+		t.Errorf("host: %v, client: %v, expected public IPs", &hostCReq.SourceAddr, &clientCReq.SourceAddr)
+	}
+}
@@ -8,8 +8,8 @@
 //
 //      IDReq ------------------------------->
 //
-//            <-------------------------------  AssID[1337]
-//      (announce on master server)
+//            <-------------------------------  AssID[1337, "[2001:db8::2]:11113"]
+//      (announce on master server)             (address only in version 2)
 //
 //                                                          <-------------------------->   C4NetIOUDP Connect
 //
@@ -32,10 +32,40 @@
 //
 //      TCP SYN  <--------------------------------------------------------------------->   TCP SYN (simultaneous open)
 //
+//      **NAT probe (version 2)**
+//
+//                                              (secondary socket 192.0.2.2:11116)
+//
+//                                                          <---------------------------   NATProbeReq[42]
+//                                              NATProbeResp[42, "203.0.113.1:1024",
+//                                                           "192.0.2.2:11116"] ------->
+//                                  (secondary) NATProbeResp[42, ...] ~~~~~~~~~~~~~~~~~~>   (raw UDP, arrives if the
+//                                                                                          NAT doesn't filter)
+//                                  (secondary) <-------------------------------------->   C4NetIOUDP Connect
+//                                  (secondary) <---------------------------------------   NATProbeReq[43]
+//                                  (secondary) NATProbeResp[43, "203.0.113.1:1024",
+//                                                           ""] ---------------------->
+//
+//      The client compares the addresses to find out whether its NAT maps
+//      the socket to the same address for every destination. See package
+//      natprobe.
+//
+// Protocol versions
+// =================
+//
+// Every message starts with a Header carrying the message type and the
+// protocol version. Version 2 appends a capability bitfield to the header.
+// The netpuncher answers each peer with the version of the peer's last
+// IDReq/SReq/SReqTCP and the capabilities both sides support, so version 1
+// clients keep working unchanged. See the Cap* constants for the optional
+// features.
+//
 package netpuncher
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding"
 	"encoding/binary"
 	"errors"
@@ -45,16 +75,22 @@ import (
 )
 
 const (
-	PID_Puncher_AssID   = 0x51 // Puncher announcing ID to client
-	PID_Puncher_SReq    = 0x52 // Client requesting to be served with punching (for an ID)
-	PID_Puncher_CReq    = 0x53 // Puncher requesting clients to punch (towards an address)
-	PID_Puncher_IDReq   = 0x54 // Client requesting an ID
-	PID_Puncher_SReqTCP = 0x62 // Client requesting to be served with TCP-punching (for an ID)
-	PID_Puncher_CReqTCP = 0x63 // Puncher requesting clients to TCP-punch (towards an address)
+	PID_Puncher_AssID        = 0x51 // Puncher announcing ID to client
+	PID_Puncher_SReq         = 0x52 // Client requesting to be served with punching (for an ID)
+	PID_Puncher_CReq         = 0x53 // Puncher requesting clients to punch (towards an address)
+	PID_Puncher_IDReq        = 0x54 // Client requesting an ID
+	PID_Puncher_NAck         = 0x55 // Puncher rejecting a request (protocol version 2)
+	PID_Puncher_NATProbeReq  = 0x56 // Client asking for its address as seen by the puncher (protocol version 2)
+	PID_Puncher_NATProbeResp = 0x57 // Puncher telling a client its address (protocol version 2)
+	PID_Puncher_SReqTCP      = 0x62 // Client requesting to be served with TCP-punching (for an ID)
+	PID_Puncher_CReqTCP      = 0x63 // Puncher requesting clients to TCP-punch (towards an address)
 )
 
-// 2 byte header, CReqTCP is largest (two port and IP)
-const MaxPacketSize = 2 + 36
+// Size of the largest Header (version 2 and later)
+const maxHeaderSize = 2 + 4
+
+// AssID with all capabilities (ID, two tokens, port and IP) is largest
+const MaxPacketSize = maxHeaderSize + 54
 
 type PuncherPacket interface {
 	Type() byte
@@ -90,15 +126,33 @@ func (n ErrNotReadEnough) Error() string {
 	return fmt.Sprintf("netpuncher: message not long enough, read %d byte", n)
 }
 
-// Reads one puncher message.
+// Message larger than MaxPacketSize.
+var ErrMessageTooLarge = ErrInvalidMessage("message too large")
+
+// Reads one puncher message. r must return a full message per Read call, like
+// a c4netioudp.Conn does.
 func ReadFrom(r io.Reader) (PuncherPacket, error) {
-	buf := make([]byte, MaxPacketSize)
+	// One byte more to detect messages which are too large.
+	buf := make([]byte, MaxPacketSize+1)
 	n, err := r.Read(buf)
-	if err != nil {
+	if err != nil && err != io.ErrShortBuffer {
 		return nil, err
 	}
-	if n < 2 {
-		return nil, ErrNotReadEnough(n)
+	return Decode(buf[:n])
+}
+
+// Decode decodes a single puncher message.
+func Decode(buf []byte) (PuncherPacket, error) {
+	if len(buf) < 2 {
+		return nil, ErrNotReadEnough(len(buf))
+	}
+	if len(buf) > MaxPacketSize {
+		// Newer protocol versions may have larger messages.
+		var h Header
+		if err := h.read(bytes.NewReader(buf)); err != nil {
+			return nil, err
+		}
+		return nil, ErrMessageTooLarge
 	}
 	var p PuncherPacket
 	switch buf[0] {
@@ -110,14 +164,20 @@ func ReadFrom(r io.Reader) (PuncherPacket, error) {
 		p = &CReq{}
 	case PID_Puncher_IDReq:
 		p = &IDReq{}
+	case PID_Puncher_NAck:
+		p = &NAck{}
 	case PID_Puncher_SReqTCP:
 		p = &SReqTCP{}
 	case PID_Puncher_CReqTCP:
 		p = &CReqTCP{}
+	case PID_Puncher_NATProbeReq:
+		p = &NATProbeReq{}
+	case PID_Puncher_NATProbeResp:
+		p = &NATProbeResp{}
 	default:
 		return nil, ErrUnknownType(buf[0])
 	}
-	if err = p.UnmarshalBinary(buf); err != nil {
+	if err := p.UnmarshalBinary(buf); err != nil {
 		return nil, err
 	}
 	return p, nil
@@ -126,39 +186,130 @@ func ReadFrom(r io.Reader) (PuncherPacket, error) {
 type ProtocolVersion byte
 
 // Newest version supported
-var NewestProtocolVersion = ProtocolVersion(1)
+var NewestProtocolVersion = ProtocolVersion(2)
 
 // Returns whether the implementation supports the protocol version.
 func (v ProtocolVersion) Supported() bool {
-	return v == 1
+	return v >= 1 && v <= NewestProtocolVersion
+}
+
+// Capabilities is a bitfield of optional protocol features. It is part of
+// the Header starting with protocol version 2.
+type Capabilities uint32
+
+const (
+	// IDReq and AssID carry a ResumeToken. A host which reconnects and sends
+	// the token from an earlier AssID gets back its previous ID.
+	CapResume Capabilities = 1 << iota
+	// A host sending IDReq with CapAuth requires clients to authenticate.
+	// AssID then carries a HostSecret, from which the host derives
+	// JoinTokens for its clients. SReq and SReqTCP carry the JoinToken.
+	CapAuth
+)
+
+// Has returns whether all capabilities in o are set in c.
+func (c Capabilities) Has(o Capabilities) bool {
+	return c&o == o
+}
+
+// ResumeToken identifies a host ID lease, see CapResume.
+type ResumeToken [16]byte
+
+// IsZero returns whether t is unset, i.e. the host requests a new ID.
+func (t ResumeToken) IsZero() bool {
+	return t == ResumeToken{}
+}
+
+// HostSecret is the key for a host's JoinTokens, see CapAuth.
+type HostSecret [16]byte
+
+// JoinToken authorizes clients to request punching for a host, see CapAuth.
+type JoinToken [16]byte
+
+// NewJoinToken derives the token clients need for punching to the host with
+// the given ID.
+func NewJoinToken(secret HostSecret, cid uint32) JoinToken {
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte("netpuncher join"))
+	binary.Write(mac, binary.LittleEndian, cid)
+	var t JoinToken
+	copy(t[:], mac.Sum(nil))
+	return t
+}
+
+// Valid returns whether t is the join token for the host with the given ID.
+func (t JoinToken) Valid(secret HostSecret, cid uint32) bool {
+	expected := NewJoinToken(secret, cid)
+	return hmac.Equal(t[:], expected[:])
 }
 
 // Header preceding all messages.
 type Header struct {
 	Type    byte // See PID_Puncher_* constants
 	Version ProtocolVersion
+	Caps    Capabilities // only on the wire for version 2 and later
 }
 
-func (h Header) MarshalBinary() ([]byte, error) {
-	var b bytes.Buffer
-	binary.Write(&b, binary.LittleEndian, h)
-	return b.Bytes(), nil
+// Negotiate returns the header for replying to a peer which sent h, given the
+// capabilities supported locally.
+func (h Header) Negotiate(caps Capabilities) Header {
+	v := h.Version
+	if v > NewestProtocolVersion {
+		v = NewestProtocolVersion
+	}
+	if v < 2 {
+		caps = 0
+	}
+	return Header{Version: v, Caps: h.Caps & caps}
 }
 
-func (h *Header) UnmarshalBinary(buf []byte) error {
-	b := bytes.NewReader(buf)
-	err := binary.Read(b, binary.LittleEndian, h)
-	if err != nil {
+// has returns whether h announces the capabilities in c. Version 1 headers
+// never do.
+func (h Header) has(c Capabilities) bool {
+	return h.Version >= 2 && h.Caps.Has(c)
+}
+
+func (h Header) write(b *bytes.Buffer) {
+	b.WriteByte(h.Type)
+	b.WriteByte(byte(h.Version))
+	if h.Version >= 2 {
+		binary.Write(b, binary.LittleEndian, h.Caps)
+	}
+}
+
+func (h *Header) read(r io.Reader) error {
+	var buf [2]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
 		return ErrInvalidMessage(err.Error())
 	}
+	h.Type = buf[0]
+	h.Version = ProtocolVersion(buf[1])
 	if !h.Version.Supported() {
 		return ErrUnsupportedVersion(h.Version)
 	}
+	h.Caps = 0
+	if h.Version >= 2 {
+		if err := binary.Read(r, binary.LittleEndian, &h.Caps); err != nil {
+			return ErrInvalidMessage(err.Error())
+		}
+	}
 	return nil
 }
 
+func (h Header) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	h.write(&b)
+	return b.Bytes(), nil
+}
+
+func (h *Header) UnmarshalBinary(buf []byte) error {
+	return h.read(bytes.NewReader(buf))
+}
+
+// ResumeToken is only sent with CapResume. A zero token requests a new ID.
 type IDReq struct {
 	Header
+	ResumeToken ResumeToken
 }
 
 func (*IDReq) Type() byte { return PID_Puncher_IDReq }
@@ -166,25 +317,36 @@ func (*IDReq) Type() byte { return PID_Puncher_IDReq }
 func (p IDReq) MarshalBinary() ([]byte, error) {
 	var b bytes.Buffer
 	p.Header.Type = p.Type()
-	binary.Write(&b, binary.LittleEndian, p)
+	p.Header.write(&b)
+	if p.Header.has(CapResume) {
+		b.Write(p.ResumeToken[:])
+	}
 	return b.Bytes(), nil
 }
 
 func (p *IDReq) UnmarshalBinary(buf []byte) error {
 	b := bytes.NewReader(buf)
-	err := binary.Read(b, binary.LittleEndian, p)
-	if err != nil {
-		return ErrInvalidMessage(err.Error())
+	if err := p.Header.read(b); err != nil {
+		return err
 	}
-	if !p.Header.Version.Supported() {
-		return ErrUnsupportedVersion(p.Header.Version)
+	p.ResumeToken = ResumeToken{}
+	if p.Header.has(CapResume) {
+		if _, err := io.ReadFull(b, p.ResumeToken[:]); err != nil {
+			return ErrInvalidMessage(err.Error())
+		}
 	}
 	return nil
 }
 
+// ResumeToken is only sent with CapResume, Secret only with CapAuth. Starting
+// with protocol version 2, Addr is the host's address as seen by the puncher,
+// encoded like in CReq.
 type AssID struct {
 	Header
-	CID uint32
+	CID         uint32
+	ResumeToken ResumeToken
+	Secret      HostSecret
+	Addr        net.UDPAddr
 }
 
 func (*AssID) Type() byte { return PID_Puncher_AssID }
@@ -193,25 +355,55 @@ func (*AssID) Type() byte { return PID_Puncher_AssID }
 func (p AssID) MarshalBinary() ([]byte, error) {
 	var b bytes.Buffer
 	p.Header.Type = p.Type()
-	binary.Write(&b, binary.LittleEndian, p)
+	p.Header.write(&b)
+	binary.Write(&b, binary.LittleEndian, p.CID)
+	if p.Header.has(CapResume) {
+		b.Write(p.ResumeToken[:])
+	}
+	if p.Header.has(CapAuth) {
+		b.Write(p.Secret[:])
+	}
+	if p.Header.Version >= 2 {
+		writeUDPAddr(&b, p.Addr)
+	}
 	return b.Bytes(), nil
 }
 
 func (p *AssID) UnmarshalBinary(buf []byte) error {
 	b := bytes.NewReader(buf)
-	err := binary.Read(b, binary.LittleEndian, p)
-	if err != nil {
+	if err := p.Header.read(b); err != nil {
+		return err
+	}
+	if err := binary.Read(b, binary.LittleEndian, &p.CID); err != nil {
 		return ErrInvalidMessage(err.Error())
 	}
-	if !p.Header.Version.Supported() {
-		return ErrUnsupportedVersion(p.Header.Version)
+	p.ResumeToken = ResumeToken{}
+	if p.Header.has(CapResume) {
+		if _, err := io.ReadFull(b, p.ResumeToken[:]); err != nil {
+			return ErrInvalidMessage(err.Error())
+		}
+	}
+	p.Secret = HostSecret{}
+	if p.Header.has(CapAuth) {
+		if _, err := io.ReadFull(b, p.Secret[:]); err != nil {
+			return ErrInvalidMessage(err.Error())
+		}
+	}
+	p.Addr = net.UDPAddr{}
+	if p.Header.Version >= 2 {
+		var err error
+		if p.Addr, err = readUDPAddr(b); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// Token is only sent with CapAuth.
 type SReq struct {
 	Header
-	CID uint32
+	CID   uint32
+	Token JoinToken
 }
 
 func (*SReq) Type() byte { return PID_Puncher_SReq }
@@ -220,18 +412,27 @@ func (*SReq) Type() byte { return PID_Puncher_SReq }
 func (p SReq) MarshalBinary() ([]byte, error) {
 	var b bytes.Buffer
 	p.Header.Type = p.Type()
-	binary.Write(&b, binary.LittleEndian, p)
+	p.Header.write(&b)
+	binary.Write(&b, binary.LittleEndian, p.CID)
+	if p.Header.has(CapAuth) {
+		b.Write(p.Token[:])
+	}
 	return b.Bytes(), nil
 }
 
 func (p *SReq) UnmarshalBinary(buf []byte) error {
 	b := bytes.NewReader(buf)
-	err := binary.Read(b, binary.LittleEndian, p)
-	if err != nil {
+	if err := p.Header.read(b); err != nil {
+		return err
+	}
+	if err := binary.Read(b, binary.LittleEndian, &p.CID); err != nil {
 		return ErrInvalidMessage(err.Error())
 	}
-	if !p.Header.Version.Supported() {
-		return ErrUnsupportedVersion(p.Header.Version)
+	p.Token = JoinToken{}
+	if p.Header.has(CapAuth) {
+		if _, err := io.ReadFull(b, p.Token[:]); err != nil {
+			return ErrInvalidMessage(err.Error())
+		}
 	}
 	return nil
 }
@@ -248,7 +449,7 @@ func (*CReq) Type() byte { return PID_Puncher_CReq }
 func (p CReq) MarshalBinary() ([]byte, error) {
 	var b bytes.Buffer
 	p.Header.Type = p.Type()
-	binary.Write(&b, binary.LittleEndian, p.Header)
+	p.Header.write(&b)
 	binary.Write(&b, binary.LittleEndian, uint16(p.Addr.Port))
 	v6 := p.Addr.IP.To16()
 	if v6 == nil {
@@ -260,11 +461,8 @@ func (p CReq) MarshalBinary() ([]byte, error) {
 
 func (p *CReq) UnmarshalBinary(buf []byte) error {
 	b := bytes.NewReader(buf)
-	if err := binary.Read(b, binary.LittleEndian, &p.Header); err != nil {
-		return ErrInvalidMessage(err.Error())
-	}
-	if !p.Header.Version.Supported() {
-		return ErrUnsupportedVersion(p.Header.Version)
+	if err := p.Header.read(b); err != nil {
+		return err
 	}
 	var port uint16
 	if err := binary.Read(b, binary.LittleEndian, &port); err != nil {
@@ -278,9 +476,11 @@ func (p *CReq) UnmarshalBinary(buf []byte) error {
 	return nil
 }
 
+// Token is only sent with CapAuth.
 type SReqTCP struct {
 	Header
-	CID uint32
+	CID   uint32
+	Token JoinToken
 }
 
 func (*SReqTCP) Type() byte { return PID_Puncher_SReqTCP }
@@ -289,18 +489,27 @@ func (*SReqTCP) Type() byte { return PID_Puncher_SReqTCP }
 func (p SReqTCP) MarshalBinary() ([]byte, error) {
 	var b bytes.Buffer
 	p.Header.Type = p.Type()
-	binary.Write(&b, binary.LittleEndian, p)
+	p.Header.write(&b)
+	binary.Write(&b, binary.LittleEndian, p.CID)
+	if p.Header.has(CapAuth) {
+		b.Write(p.Token[:])
+	}
 	return b.Bytes(), nil
 }
 
 func (p *SReqTCP) UnmarshalBinary(buf []byte) error {
 	b := bytes.NewReader(buf)
-	err := binary.Read(b, binary.LittleEndian, p)
-	if err != nil {
+	if err := p.Header.read(b); err != nil {
+		return err
+	}
+	if err := binary.Read(b, binary.LittleEndian, &p.CID); err != nil {
 		return ErrInvalidMessage(err.Error())
 	}
-	if !p.Header.Version.Supported() {
-		return ErrUnsupportedVersion(p.Header.Version)
+	p.Token = JoinToken{}
+	if p.Header.has(CapAuth) {
+		if _, err := io.ReadFull(b, p.Token[:]); err != nil {
+			return ErrInvalidMessage(err.Error())
+		}
 	}
 	return nil
 }
@@ -342,7 +551,7 @@ func readTCPAddr(r io.Reader) (net.TCPAddr, error) {
 func (p CReqTCP) MarshalBinary() ([]byte, error) {
 	var b bytes.Buffer
 	p.Header.Type = p.Type()
-	binary.Write(&b, binary.LittleEndian, p.Header)
+	p.Header.write(&b)
 	err := writeTCPAddr(&b, p.SourceAddr)
 	if err != nil {
 		return nil, err
@@ -356,11 +565,8 @@ func (p CReqTCP) MarshalBinary() ([]byte, error) {
 
 func (p *CReqTCP) UnmarshalBinary(buf []byte) error {
 	b := bytes.NewReader(buf)
-	if err := binary.Read(b, binary.LittleEndian, &p.Header); err != nil {
-		return ErrInvalidMessage(err.Error())
-	}
-	if !p.Header.Version.Supported() {
-		return ErrUnsupportedVersion(p.Header.Version)
+	if err := p.Header.read(b); err != nil {
+		return err
 	}
 	var err error
 	p.SourceAddr, err = readTCPAddr(b)
@@ -373,3 +579,182 @@ func (p *CReqTCP) UnmarshalBinary(buf []byte) error {
 	}
 	return nil
 }
+
+func writeUDPAddr(b *bytes.Buffer, addr net.UDPAddr) {
+	binary.Write(b, binary.LittleEndian, uint16(addr.Port))
+	var ip [16]byte
+	copy(ip[:], addr.IP.To16())
+	b.Write(ip[:])
+}
+
+// readUDPAddr reads an address written by writeUDPAddr. The unset address
+// results in an empty net.UDPAddr.
+func readUDPAddr(r io.Reader) (net.UDPAddr, error) {
+	var port uint16
+	if err := binary.Read(r, binary.LittleEndian, &port); err != nil {
+		return net.UDPAddr{}, ErrInvalidMessage(err.Error())
+	}
+	var ip [16]byte
+	if err := binary.Read(r, binary.LittleEndian, &ip); err != nil {
+		return net.UDPAddr{}, ErrInvalidMessage(err.Error())
+	}
+	if port == 0 && ip == [16]byte{} {
+		return net.UDPAddr{}, nil
+	}
+	return net.UDPAddr{Port: int(port), IP: ip[:]}, nil
+}
+
+// Returned for NAT probe messages with protocol version 1.
+var errProbeVersion = ErrInvalidMessage("NAT probes require protocol version 2")
+
+// NATProbeReq asks the puncher for the address it sees the client at. Nonce
+// is copied into the response.
+type NATProbeReq struct {
+	Header
+	Nonce uint32
+}
+
+func (*NATProbeReq) Type() byte { return PID_Puncher_NATProbeReq }
+
+// Fails for protocol version 1
+func (p NATProbeReq) MarshalBinary() ([]byte, error) {
+	if p.Header.Version < 2 {
+		return nil, errProbeVersion
+	}
+	var b bytes.Buffer
+	p.Header.Type = p.Type()
+	p.Header.write(&b)
+	binary.Write(&b, binary.LittleEndian, p.Nonce)
+	return b.Bytes(), nil
+}
+
+func (p *NATProbeReq) UnmarshalBinary(buf []byte) error {
+	b := bytes.NewReader(buf)
+	if err := p.Header.read(b); err != nil {
+		return err
+	}
+	if p.Header.Version < 2 {
+		return errProbeVersion
+	}
+	if err := binary.Read(b, binary.LittleEndian, &p.Nonce); err != nil {
+		return ErrInvalidMessage(err.Error())
+	}
+	return nil
+}
+
+// NATProbeResp answers a NATProbeReq. Addr is the client's address as seen
+// by the puncher. ProbeAddr is the puncher's secondary address, which
+// additionally sends the response as a plain UDP packet without C4NetIOUDP
+// framing. It is unset if the puncher has no secondary address or the
+// response comes from the secondary address. An unspecified IP in ProbeAddr
+// stands for the IP of the puncher. Addresses are encoded like in CReq, the
+// unset address as zero.
+type NATProbeResp struct {
+	Header
+	Nonce     uint32
+	Addr      net.UDPAddr
+	ProbeAddr net.UDPAddr
+}
+
+func (*NATProbeResp) Type() byte { return PID_Puncher_NATProbeResp }
+
+// Fails for protocol version 1
+func (p NATProbeResp) MarshalBinary() ([]byte, error) {
+	if p.Header.Version < 2 {
+		return nil, errProbeVersion
+	}
+	var b bytes.Buffer
+	p.Header.Type = p.Type()
+	p.Header.write(&b)
+	binary.Write(&b, binary.LittleEndian, p.Nonce)
+	writeUDPAddr(&b, p.Addr)
+	writeUDPAddr(&b, p.ProbeAddr)
+	return b.Bytes(), nil
+}
+
+func (p *NATProbeResp) UnmarshalBinary(buf []byte) error {
+	b := bytes.NewReader(buf)
+	if err := p.Header.read(b); err != nil {
+		return err
+	}
+	if p.Header.Version < 2 {
+		return errProbeVersion
+	}
+	if err := binary.Read(b, binary.LittleEndian, &p.Nonce); err != nil {
+		return ErrInvalidMessage(err.Error())
+	}
+	var err error
+	if p.Addr, err = readUDPAddr(b); err != nil {
+		return err
+	}
+	p.ProbeAddr, err = readUDPAddr(b)
+	return err
+}
+
+// Reason for rejecting a request, see NAck.
+type NAckReason byte
+
+const (
+	NAckAuthFailed         NAckReason = 1 // missing or invalid JoinToken
+	NAckUnknownHost        NAckReason = 2 // no host with the requested ID
+	NAckUnsupportedVersion NAckReason = 3 // the NAck carries the newest version the puncher supports
+	NAckRateLimited        NAckReason = 4 // too many requests, try again later
+	NAckInvalidMessage     NAckReason = 5 // message could not be decoded
+)
+
+func (r NAckReason) String() string {
+	switch r {
+	case NAckAuthFailed:
+		return "authentication failed"
+	case NAckUnknownHost:
+		return "unknown host"
+	case NAckUnsupportedVersion:
+		return "unsupported version"
+	case NAckRateLimited:
+		return "rate limited"
+	case NAckInvalidMessage:
+		return "invalid message"
+	}
+	return fmt.Sprintf("unknown reason %d", byte(r))
+}
+
+// NAck tells a client that the puncher rejected its request. Request is the
+// type of the rejected message (0 if unknown), CID the host ID it referred to
+// (if any). Only sent to peers using protocol version 2 or later, and in
+// reply to messages with a newer version.
+type NAck struct {
+	Header
+	Request byte
+	CID     uint32
+	Reason  NAckReason
+}
+
+func (*NAck) Type() byte { return PID_Puncher_NAck }
+
+// error is always nil
+func (p NAck) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	p.Header.Type = p.Type()
+	p.Header.write(&b)
+	b.WriteByte(p.Request)
+	binary.Write(&b, binary.LittleEndian, p.CID)
+	b.WriteByte(byte(p.Reason))
+	return b.Bytes(), nil
+}
+
+func (p *NAck) UnmarshalBinary(buf []byte) error {
+	b := bytes.NewReader(buf)
+	if err := p.Header.read(b); err != nil {
+		return err
+	}
+	var fields struct {
+		Request byte
+		CID     uint32
+		Reason  NAckReason
+	}
+	if err := binary.Read(b, binary.LittleEndian, &fields); err != nil {
+		return ErrInvalidMessage(err.Error())
+	}
+	p.Request, p.CID, p.Reason = fields.Request, fields.CID, fields.Reason
+	return nil
+}
@@ -0,0 +1,76 @@
+//go:build go1.18
+// +build go1.18
+
+package netpuncher
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func addSamples(f *testing.F) {
+	for _, pkt := range samplePackets {
+		buf, err := pkt.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf)
+	}
+}
+
+// Decode and ReadFrom agree, and decoded messages survive a roundtrip.
+func FuzzDecode(f *testing.F) {
+	addSamples(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pkt, err := Decode(data)
+		pkt2, err2 := ReadFrom(bytes.NewReader(data))
+		if (err == nil) != (err2 == nil) {
+			t.Fatalf("Decode() error %v, ReadFrom() error %v", err, err2)
+		}
+		if err != nil {
+			return
+		}
+		if !reflect.DeepEqual(pkt, pkt2) {
+			t.Fatalf("Decode() = %+v, ReadFrom() = %+v", pkt, pkt2)
+		}
+		buf, err := pkt.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%T.MarshalBinary(): %v", pkt, err)
+		}
+		if len(buf) > MaxPacketSize {
+			t.Fatalf("%T has %d byte, MaxPacketSize is %d", pkt, len(buf), MaxPacketSize)
+		}
+		cpy, err := Decode(buf)
+		if err != nil {
+			t.Fatalf("decoding %x: %v", buf, err)
+		}
+		if !reflect.DeepEqual(pkt, cpy) {
+			t.Fatalf("%+v != %+v after roundtrip", pkt, cpy)
+		}
+	})
+}
+
+// Every UnmarshalBinary handles arbitrary input without panicking.
+func FuzzUnmarshalBinary(f *testing.F) {
+	addSamples(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, sample := range samplePackets {
+			pkt := reflect.New(reflect.Indirect(reflect.ValueOf(sample)).Type()).Interface().(PuncherPacket)
+			if err := pkt.UnmarshalBinary(data); err != nil || data[0] != pkt.Type() {
+				continue
+			}
+			buf, err := pkt.MarshalBinary()
+			if err != nil {
+				t.Fatalf("%T.MarshalBinary(): %v", pkt, err)
+			}
+			cpy := reflect.New(reflect.Indirect(reflect.ValueOf(sample)).Type()).Interface().(PuncherPacket)
+			if err := cpy.UnmarshalBinary(buf); err != nil {
+				t.Fatalf("%T.UnmarshalBinary(%x): %v", pkt, buf, err)
+			}
+			if !reflect.DeepEqual(pkt, cpy) {
+				t.Fatalf("%+v != %+v after roundtrip", pkt, cpy)
+			}
+		}
+	})
+}
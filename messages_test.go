@@ -9,13 +9,32 @@ import (
 
 const version = 1
 
+var resumeToken = ResumeToken{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+var hostSecret = HostSecret{16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}
+var joinToken = NewJoinToken(hostSecret, 0xf0f0f0f0)
+
 var samplePackets = []PuncherPacket{
-	&IDReq{Header{PID_Puncher_IDReq, version}},
-	&AssID{Header{PID_Puncher_AssID, version}, 0xf0f0f0f0},
-	&SReq{Header{PID_Puncher_SReq, version}, 0xf0f0f0f0},
-	&CReq{Header{PID_Puncher_CReq, version}, net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}},
-	&SReqTCP{Header{PID_Puncher_SReqTCP, version}, 0xf1f1f1f1},
-	&CReqTCP{Header{PID_Puncher_CReqTCP, version}, net.TCPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}, net.TCPAddr{Port: 0xff22, IP: net.ParseIP("2001:db8::1338")}},
+	&IDReq{Header{PID_Puncher_IDReq, version, 0}, ResumeToken{}},
+	&AssID{Header{PID_Puncher_AssID, version, 0}, 0xf0f0f0f0, ResumeToken{}, HostSecret{}, net.UDPAddr{}},
+	&SReq{Header{PID_Puncher_SReq, version, 0}, 0xf0f0f0f0, JoinToken{}},
+	&CReq{Header{PID_Puncher_CReq, version, 0}, net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}},
+	&SReqTCP{Header{PID_Puncher_SReqTCP, version, 0}, 0xf1f1f1f1, JoinToken{}},
+	&CReqTCP{Header{PID_Puncher_CReqTCP, version, 0}, net.TCPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}, net.TCPAddr{Port: 0xff22, IP: net.ParseIP("2001:db8::1338")}},
+
+	&IDReq{Header{PID_Puncher_IDReq, 2, 0}, ResumeToken{}},
+	&IDReq{Header{PID_Puncher_IDReq, 2, CapResume}, resumeToken},
+	&AssID{Header{PID_Puncher_AssID, 2, 0}, 0xf0f0f0f0, ResumeToken{}, HostSecret{}, net.UDPAddr{}},
+	&AssID{Header{PID_Puncher_AssID, 2, CapResume}, 0xf0f0f0f0, resumeToken, HostSecret{}, net.UDPAddr{Port: 0xff11, IP: net.ParseIP("192.0.2.1")}},
+	&AssID{Header{PID_Puncher_AssID, 2, CapResume | CapAuth}, 0xf0f0f0f0, resumeToken, hostSecret, net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}},
+	&SReq{Header{PID_Puncher_SReq, 2, 0}, 0xf0f0f0f0, JoinToken{}},
+	&SReq{Header{PID_Puncher_SReq, 2, CapAuth}, 0xf0f0f0f0, joinToken},
+	&CReq{Header{PID_Puncher_CReq, 2, 0xa5a5a5a5}, net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}},
+	&SReqTCP{Header{PID_Puncher_SReqTCP, 2, CapAuth}, 0xf1f1f1f1, joinToken},
+	&NAck{Header{PID_Puncher_NAck, 2, 0}, PID_Puncher_SReq, 0xf0f0f0f0, NAckAuthFailed},
+	&CReqTCP{Header{PID_Puncher_CReqTCP, 2, 0xa5a5a5a5}, net.TCPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}, net.TCPAddr{Port: 0xff22, IP: net.ParseIP("2001:db8::1338")}},
+	&NATProbeReq{Header{PID_Puncher_NATProbeReq, 2, 0}, 0xf2f2f2f2},
+	&NATProbeResp{Header{PID_Puncher_NATProbeResp, 2, 0}, 0xf2f2f2f2, net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}, net.UDPAddr{Port: 0xff22, IP: net.ParseIP("2001:db8::1338")}},
+	&NATProbeResp{Header{PID_Puncher_NATProbeResp, 2, 0xa5a5a5a5}, 0xf2f2f2f2, net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}, net.UDPAddr{}},
 }
 
 func TestMarshalRoundtrip(t *testing.T) {
@@ -60,3 +79,79 @@ func TestUnsupportedVersion(t *testing.T) {
 		}
 	}
 }
+
+// Messages must be neither truncated nor larger than MaxPacketSize.
+func TestMessageSize(t *testing.T) {
+	buf, _ := AssID{Header: Header{Version: 2, Caps: CapResume | CapAuth}, CID: 1}.MarshalBinary()
+	if _, err := Decode(buf[:len(buf)-1]); err == nil {
+		t.Error("Decode() accepted truncated message")
+	}
+	long := append(buf, make([]byte, MaxPacketSize)...)
+	if _, err := Decode(long); err != ErrMessageTooLarge {
+		t.Errorf("Decode() of oversized message: %v", err)
+	}
+	if _, err := ReadFrom(bytes.NewReader(long)); err != ErrMessageTooLarge {
+		t.Errorf("ReadFrom() of oversized message: %v", err)
+	}
+}
+
+// Version 1 messages must keep their wire format.
+func TestVersion1WireFormat(t *testing.T) {
+	buf, _ := AssID{Header: Header{Version: 1, Caps: 0xff}, CID: 0x04030201}.MarshalBinary()
+	expected := []byte{PID_Puncher_AssID, 1, 1, 2, 3, 4}
+	if !bytes.Equal(buf, expected) {
+		t.Errorf("AssID v1 = %x, expected %x", buf, expected)
+	}
+	buf, _ = AssID{Header: Header{Version: 2, Caps: 0x0a0b0c00}, CID: 0x04030201}.MarshalBinary()
+	expected = append([]byte{PID_Puncher_AssID, 2, 0x00, 0x0c, 0x0b, 0x0a, 1, 2, 3, 4}, make([]byte, 18)...)
+	if !bytes.Equal(buf, expected) {
+		t.Errorf("AssID v2 = %x, expected %x", buf, expected)
+	}
+}
+
+// Version 2 AssIDs must carry the address.
+func TestAssIDWithoutAddr(t *testing.T) {
+	buf := []byte{PID_Puncher_AssID, 2, 0, 0, 0, 0, 1, 2, 3, 4}
+	if _, err := Decode(buf); err == nil {
+		t.Error("Decode() accepted AssID without address")
+	}
+	if _, err := Decode(append(buf, 1, 2, 3)); err == nil {
+		t.Error("Decode() accepted truncated address")
+	}
+	if _, err := Decode(append(buf, make([]byte, 18)...)); err != nil {
+		t.Errorf("Decode() of AssID with unset address: %v", err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		req      Header
+		caps     Capabilities
+		expected Header
+	}{
+		{Header{Version: 1, Caps: 0}, 0xff, Header{Version: 1}},
+		{Header{Version: 2, Caps: 0x0f}, 0x3c, Header{Version: 2, Caps: 0x0c}},
+		{Header{Version: 2, Caps: 0x0f}, 0, Header{Version: 2}},
+	}
+	for _, test := range tests {
+		if h := test.req.Negotiate(test.caps); h != test.expected {
+			t.Errorf("%+v.Negotiate(%x) = %+v, expected %+v", test.req, test.caps, h, test.expected)
+		}
+	}
+}
+
+func TestJoinToken(t *testing.T) {
+	token := NewJoinToken(hostSecret, 1337)
+	if !token.Valid(hostSecret, 1337) {
+		t.Error("token not valid for its host")
+	}
+	if token.Valid(hostSecret, 1338) {
+		t.Error("token valid for another host ID")
+	}
+	if token.Valid(HostSecret{}, 1337) {
+		t.Error("token valid with another secret")
+	}
+	if (JoinToken{}).Valid(hostSecret, 1337) {
+		t.Error("zero token valid")
+	}
+}
@@ -0,0 +1,329 @@
+// Package natprobe finds out how the NAT in front of a c4netioudp listener
+// behaves, using the NAT probe messages of the netpuncher. See messages.go
+// for the protocol flow.
+//
+//	prober := natprobe.New()
+//	lc := c4netioudp.ListenConfig{UnhandledPacket: prober.HandlePacket}
+//	listener, _ := lc.Listen("udp", &net.UDPAddr{})
+//	result, err := prober.Probe(ctx, listener, netpuncherAddr)
+//	fmt.Println(result)
+package natprobe
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/openclonk/netpuncher"
+	"github.com/openclonk/netpuncher/c4netioudp"
+)
+
+// Time to wait for replies without a deadline on the context
+const probeTimeout = 5 * time.Second
+
+// Time to wait for the plain UDP response from the secondary address
+const DefaultUnsolicitedWait = 500 * time.Millisecond
+
+// Returned by Probe if the netpuncher doesn't know NAT probes.
+var ErrNotSupported = errors.New("natprobe: netpuncher doesn't support NAT probes")
+
+// Returned by Probe if the netpuncher rejected the probe because of its rate
+// limits.
+var ErrRateLimited = errors.New("natprobe: rate limited by netpuncher")
+
+// Mapping describes how a NAT assigns public addresses.
+type Mapping int
+
+const (
+	MappingUnknown Mapping = iota
+	// No NAT: The socket is reachable at its local address.
+	MappingNone
+	// The NAT uses the same public address for all destinations.
+	MappingEndpointIndependent
+	// The NAT uses a different public address for each destination
+	// (symmetric NAT).
+	MappingEndpointDependent
+)
+
+func (m Mapping) String() string {
+	switch m {
+	case MappingNone:
+		return "no NAT"
+	case MappingEndpointIndependent:
+		return "endpoint independent"
+	case MappingEndpointDependent:
+		return "endpoint dependent"
+	}
+	return "unknown"
+}
+
+// Filtering describes which incoming packets a NAT lets through. The probe
+// only has a single secondary address, so it can't tell all behaviors apart:
+// Address dependent filtering (only IPs the socket sent packets to can reply)
+// is always reported together with one of the others.
+type Filtering int
+
+const (
+	FilteringUnknown Filtering = iota
+	// Everybody can send packets to the public address.
+	FilteringEndpointIndependent
+	// Only addresses the socket sent packets to can reply.
+	FilteringAddressPortDependent
+	// Endpoint independent or address dependent filtering
+	FilteringNotPortDependent
+	// Address dependent or address and port dependent filtering
+	FilteringNotEndpointIndependent
+)
+
+func (f Filtering) String() string {
+	switch f {
+	case FilteringEndpointIndependent:
+		return "endpoint independent"
+	case FilteringAddressPortDependent:
+		return "address and port dependent"
+	case FilteringNotPortDependent:
+		return "endpoint independent or address dependent"
+	case FilteringNotEndpointIndependent:
+		return "address dependent or address and port dependent"
+	}
+	return "unknown"
+}
+
+// Result holds the observations of a probe.
+type Result struct {
+	Local       *net.UDPAddr // local address of the listener
+	Server      *net.UDPAddr // netpuncher address
+	ProbeAddr   *net.UDPAddr // secondary address of the netpuncher, nil if it has none
+	Mapped      *net.UDPAddr // our address as seen by the netpuncher
+	ProbeMapped *net.UDPAddr // our address as seen by ProbeAddr
+	Unsolicited bool         // the plain UDP response from ProbeAddr arrived
+}
+
+// Mapping classifies the NAT's mapping behavior.
+func (r *Result) Mapping() Mapping {
+	switch {
+	case r.Mapped == nil:
+		return MappingUnknown
+	case isLocal(r.Local, r.Mapped):
+		return MappingNone
+	case r.ProbeMapped == nil:
+		return MappingUnknown
+	case r.Mapped.String() == r.ProbeMapped.String():
+		return MappingEndpointIndependent
+	}
+	return MappingEndpointDependent
+}
+
+// Filtering classifies the NAT's filtering behavior.
+func (r *Result) Filtering() Filtering {
+	if r.ProbeAddr == nil {
+		return FilteringUnknown
+	}
+	sameIP := r.ProbeAddr.IP.Equal(r.Server.IP)
+	switch {
+	case r.Unsolicited && !sameIP:
+		return FilteringEndpointIndependent
+	case r.Unsolicited:
+		return FilteringNotPortDependent
+	case sameIP:
+		return FilteringAddressPortDependent
+	}
+	return FilteringNotEndpointIndependent
+}
+
+// String returns the classic name of the NAT type.
+func (r *Result) String() string {
+	switch r.Mapping() {
+	case MappingNone:
+		if r.ProbeAddr != nil && !r.Unsolicited {
+			return "no NAT, firewalled"
+		}
+		return "no NAT"
+	case MappingEndpointDependent:
+		return "symmetric NAT"
+	case MappingEndpointIndependent:
+		switch r.Filtering() {
+		case FilteringEndpointIndependent:
+			return "full cone NAT"
+		case FilteringAddressPortDependent:
+			return "port restricted cone NAT"
+		case FilteringNotPortDependent:
+			return "full cone or restricted cone NAT"
+		case FilteringNotEndpointIndependent:
+			return "restricted cone or port restricted cone NAT"
+		}
+		return "cone NAT"
+	}
+	if r.Mapped != nil {
+		return fmt.Sprintf("unknown NAT type, public address %v", r.Mapped)
+	}
+	return "unknown NAT type"
+}
+
+// isLocal returns whether mapped is the listener's own address.
+func isLocal(local, mapped *net.UDPAddr) bool {
+	if local == nil || local.Port != mapped.Port {
+		return false
+	}
+	if !local.IP.IsUnspecified() {
+		return local.IP.Equal(mapped.IP)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(mapped.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prober runs NAT probes. Its HandlePacket method has to be set as
+// ListenConfig.UnhandledPacket of the listeners used with Probe.
+type Prober struct {
+	// Time to wait for the plain UDP response from the secondary address.
+	// Defaults to DefaultUnsolicitedWait.
+	UnsolicitedWait time.Duration
+
+	mu      sync.Mutex
+	waiting map[uint32]chan struct{} // probes waiting for the plain UDP response, by nonce
+}
+
+func New() *Prober {
+	return &Prober{waiting: make(map[uint32]chan struct{})}
+}
+
+// HandlePacket receives the plain UDP responses of the secondary address.
+func (p *Prober) HandlePacket(addr *net.UDPAddr, b []byte) {
+	msg, err := netpuncher.Decode(b)
+	if err != nil {
+		return
+	}
+	resp, ok := msg.(*netpuncher.NATProbeResp)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ch, ok := p.waiting[resp.Nonce]; ok {
+		delete(p.waiting, resp.Nonce)
+		close(ch)
+	}
+}
+
+// Probe classifies the NAT in front of listener with the help of the
+// netpuncher at raddr.
+func (p *Prober) Probe(ctx context.Context, listener *c4netioudp.Listener, raddr *net.UDPAddr) (*Result, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, probeTimeout)
+		defer cancel()
+	}
+	r := &Result{Server: raddr}
+	r.Local, _ = listener.Addr().(*net.UDPAddr)
+
+	// Register for the plain UDP response before sending the request.
+	nonce, err := randomNonce()
+	if err != nil {
+		return nil, err
+	}
+	unsolicited := make(chan struct{})
+	p.mu.Lock()
+	p.waiting[nonce] = unsolicited
+	p.mu.Unlock()
+	defer func(nonce uint32) {
+		p.mu.Lock()
+		delete(p.waiting, nonce)
+		p.mu.Unlock()
+	}(nonce)
+
+	resp, err := request(ctx, listener, raddr, nonce)
+	if err != nil {
+		return nil, err
+	}
+	r.Mapped = &resp.Addr
+	if resp.ProbeAddr.Port == 0 {
+		return r, nil
+	}
+	r.ProbeAddr = &net.UDPAddr{IP: resp.ProbeAddr.IP, Port: resp.ProbeAddr.Port}
+	if r.ProbeAddr.IP.IsUnspecified() {
+		r.ProbeAddr.IP = raddr.IP
+	}
+
+	// Only contact the secondary address after waiting for the plain UDP
+	// response, as that would open the NAT for it.
+	wait := p.UnsolicitedWait
+	if wait == 0 {
+		wait = DefaultUnsolicitedWait
+	}
+	timer := time.NewTimer(wait)
+	select {
+	case <-unsolicited:
+		r.Unsolicited = true
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+		return nil, ctx.Err()
+	}
+	timer.Stop()
+
+	if nonce, err = randomNonce(); err != nil {
+		return nil, err
+	}
+	resp, err = request(ctx, listener, r.ProbeAddr, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("natprobe: secondary address %v: %w", r.ProbeAddr, err)
+	}
+	r.ProbeMapped = &resp.Addr
+	return r, nil
+}
+
+// request connects to raddr and sends a NATProbeReq.
+func request(ctx context.Context, listener *c4netioudp.Listener, raddr *net.UDPAddr, nonce uint32) (*netpuncher.NATProbeResp, error) {
+	conn, err := listener.DialContext(ctx, raddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	buf, err := netpuncher.NATProbeReq{Header: netpuncher.Header{Version: 2}, Nonce: nonce}.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	for {
+		msg, err := netpuncher.ReadFrom(conn)
+		if err != nil {
+			return nil, err
+		}
+		switch msg := msg.(type) {
+		case *netpuncher.NATProbeResp:
+			if msg.Nonce == nonce {
+				return msg, nil
+			}
+		case *netpuncher.NAck:
+			if msg.Reason == netpuncher.NAckRateLimited {
+				return nil, ErrRateLimited
+			}
+			return nil, ErrNotSupported
+		}
+	}
+}
+
+func randomNonce() (uint32, error) {
+	var b [4]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b[:]), nil
+}
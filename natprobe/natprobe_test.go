@@ -0,0 +1,34 @@
+package natprobe
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	local := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 11112}
+	server := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 11115}
+	otherIP := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 11116}
+	samePort := &net.UDPAddr{IP: server.IP, Port: 11116}
+	mapped := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 11112}
+	mapped2 := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1024}
+	for _, test := range []struct {
+		r        Result
+		mapping  Mapping
+		expected string
+	}{
+		{Result{Local: local, Server: server}, MappingUnknown, "unknown NAT type"},
+		{Result{Local: local, Server: server, Mapped: mapped}, MappingUnknown, "unknown NAT type, public address 198.51.100.1:11112"},
+		{Result{Local: mapped, Server: server, Mapped: mapped}, MappingNone, "no NAT"},
+		{Result{Local: mapped, Server: server, ProbeAddr: otherIP, Mapped: mapped, ProbeMapped: mapped}, MappingNone, "no NAT, firewalled"},
+		{Result{Local: local, Server: server, ProbeAddr: otherIP, Mapped: mapped, ProbeMapped: mapped, Unsolicited: true}, MappingEndpointIndependent, "full cone NAT"},
+		{Result{Local: local, Server: server, ProbeAddr: samePort, Mapped: mapped, ProbeMapped: mapped, Unsolicited: true}, MappingEndpointIndependent, "full cone or restricted cone NAT"},
+		{Result{Local: local, Server: server, ProbeAddr: otherIP, Mapped: mapped, ProbeMapped: mapped}, MappingEndpointIndependent, "restricted cone or port restricted cone NAT"},
+		{Result{Local: local, Server: server, ProbeAddr: samePort, Mapped: mapped, ProbeMapped: mapped}, MappingEndpointIndependent, "port restricted cone NAT"},
+		{Result{Local: local, Server: server, ProbeAddr: samePort, Mapped: mapped, ProbeMapped: mapped2}, MappingEndpointDependent, "symmetric NAT"},
+	} {
+		if m, s := test.r.Mapping(), test.r.String(); m != test.mapping || s != test.expected {
+			t.Errorf("%+v: %s, %q, expected %s, %q", test.r, m, s, test.mapping, test.expected)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// An IDAllocator assigns IDs to new connections. Hosts announce their ID on
+// the master server and clients use it to request punching, so IDs must be
+// unique and should be hard to guess.
+type IDAllocator interface {
+	// AllocateID returns a new ID. taken reports whether an ID is already in
+	// use (by a connection or a host ID lease) and must not be returned.
+	AllocateID(taken func(id uint32) bool) (uint32, error)
+}
+
+// Returned by RandomIDAllocator if it doesn't find a free ID.
+var ErrNoFreeID = errors.New("netpuncher server: no free ID found")
+
+// Number of random IDs RandomIDAllocator tries before giving up.
+const maxAllocAttempts = 64
+
+// RandomIDAllocator picks IDs uniformly at random from a cryptographically
+// secure source, retrying on collisions.
+type RandomIDAllocator struct {
+	Rand io.Reader // source of random bytes, defaults to crypto/rand.Reader
+}
+
+func (a RandomIDAllocator) AllocateID(taken func(id uint32) bool) (uint32, error) {
+	r := a.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+	var buf [4]byte
+	for i := 0; i < maxAllocAttempts; i++ {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return 0, err
+		}
+		id := binary.LittleEndian.Uint32(buf[:])
+		if !taken(id) {
+			return id, nil
+		}
+	}
+	return 0, ErrNoFreeID
+}
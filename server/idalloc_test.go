@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// idReader returns a reader yielding the given IDs as random bytes.
+func idReader(ids ...uint32) *bytes.Reader {
+	var b bytes.Buffer
+	for _, id := range ids {
+		binary.Write(&b, binary.LittleEndian, id)
+	}
+	return bytes.NewReader(b.Bytes())
+}
+
+func TestRandomIDAllocatorCollision(t *testing.T) {
+	taken := func(id uint32) bool { return id == 1 || id == 2 }
+	a := RandomIDAllocator{Rand: idReader(1, 2, 1, 3)}
+	id, err := a.AllocateID(taken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 3 {
+		t.Errorf("got ID %d, expected 3", id)
+	}
+}
+
+func TestRandomIDAllocatorExhausted(t *testing.T) {
+	ids := make([]uint32, maxAllocAttempts+1)
+	for i := range ids {
+		ids[i] = 1
+	}
+	taken := func(id uint32) bool { return id == 1 }
+	a := RandomIDAllocator{Rand: idReader(ids...)}
+	if _, err := a.AllocateID(taken); err != ErrNoFreeID {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// The server never hands out an ID twice.
+func TestServerIDCollision(t *testing.T) {
+	accepted := make(chan *Conn, 2)
+	s := Server{
+		IDAllocator: RandomIDAllocator{Rand: idReader(7, 7, 8)},
+		AcceptConn: func(c *Conn, err error) {
+			if err != nil {
+				t.Errorf("AcceptConn: %v", err)
+				return
+			}
+			accepted <- c
+		},
+	}
+	raddr := listen(t, &s)
+	defer s.Close()
+
+	ids := make(map[uint32]bool)
+	for i := 0; i < 2; i++ {
+		dial(t, raddr)
+		select {
+		case c := <-accepted:
+			ids[c.ID] = true
+		case <-time.After(1 * time.Second):
+			t.Fatal("timeout waiting for accept")
+		}
+	}
+	if !ids[7] || !ids[8] {
+		t.Errorf("unexpected IDs %v", ids)
+	}
+}
+
+// IDs reserved by leases are not reused.
+func TestServerIDLeaseReserved(t *testing.T) {
+	leases := newLeaseTable(1 * time.Minute)
+	host := &Conn{ID: 7}
+	l := leases.acquire(host, [16]byte{}, time.Now())
+	leases.release(l, time.Now())
+	conns := map[uint32]*Conn{8: {ID: 8}}
+	a := RandomIDAllocator{Rand: idReader(7, 8, 9)}
+	if id, err := a.AllocateID(idTaken(conns, leases, NewMemoryRegistry())); err != nil || id != 9 {
+		t.Errorf("AllocateID() = %d, %v; expected 9", id, err)
+	}
+}
+
+// Failing to allocate an ID only refuses that connection.
+func TestServerIDExhausted(t *testing.T) {
+	ids := []uint32{7}
+	for i := 0; i < maxAllocAttempts; i++ {
+		ids = append(ids, 7)
+	}
+	ids = append(ids, 8)
+	accepted := make(chan *Conn, 2)
+	allocErrs := make(chan error, 1)
+	s := Server{
+		IDAllocator: RandomIDAllocator{Rand: idReader(ids...)},
+		AcceptConn: func(c *Conn, err error) {
+			if err != nil {
+				t.Errorf("AcceptConn: %v", err)
+				return
+			}
+			accepted <- c
+		},
+		AllocErr: func(addr net.Addr, err error) {
+			allocErrs <- err
+		},
+	}
+	raddr := listen(t, &s)
+	defer s.Close()
+
+	expect := func(id uint32) {
+		t.Helper()
+		dial(t, raddr)
+		select {
+		case c := <-accepted:
+			if c.ID != id {
+				t.Errorf("got ID %d, expected %d", c.ID, id)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatal("timeout waiting for accept")
+		}
+	}
+	expect(7)
+	dial(t, raddr)
+	select {
+	case err := <-allocErrs:
+		if err != ErrNoFreeID {
+			t.Errorf("AllocErr: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("AllocErr not called")
+	}
+	expect(8)
+}
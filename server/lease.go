@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/rand"
+	"io"
+	"time"
+
+	"github.com/openclonk/netpuncher"
+)
+
+// A lease keeps a host ID reserved after the host disconnects, so that the
+// host can get the same ID back by sending the lease's ResumeToken.
+type lease struct {
+	id      uint32
+	token   netpuncher.ResumeToken
+	conn    *Conn                  // host holding the lease, nil while disconnected
+	expires time.Time              // end of the grace period while disconnected
+	secret  *netpuncher.HostSecret // kept for resumed hosts requiring auth
+}
+
+// leaseTable tracks all leases. It is only used from the server's main loop.
+type leaseTable struct {
+	duration time.Duration // grace period after disconnecting
+	leases   map[netpuncher.ResumeToken]*lease
+	ids      map[uint32]*lease // same leases, by host ID
+}
+
+func newLeaseTable(duration time.Duration) *leaseTable {
+	return &leaseTable{
+		duration: duration,
+		leases:   make(map[netpuncher.ResumeToken]*lease),
+		ids:      make(map[uint32]*lease),
+	}
+}
+
+// reserved returns whether a lease holds id.
+func (t *leaseTable) reserved(id uint32) bool {
+	_, ok := t.ids[id]
+	return ok
+}
+
+func (t *leaseTable) remove(l *lease) {
+	delete(t.leases, l.token)
+	if t.ids[l.id] == l {
+		delete(t.ids, l.id)
+	}
+}
+
+// move changes the ID a lease holds.
+func (t *leaseTable) move(l *lease, id uint32) {
+	if t.ids[l.id] == l {
+		delete(t.ids, l.id)
+	}
+	l.id = id
+	t.ids[id] = l
+}
+
+// acquire returns the lease for token if it is still valid. Otherwise, it
+// creates a new lease for the host's current ID. Returns nil if no token
+// could be generated.
+func (t *leaseTable) acquire(host *Conn, token netpuncher.ResumeToken, now time.Time) *lease {
+	if l, ok := t.leases[token]; ok && !token.IsZero() {
+		if l.conn != nil || now.Before(l.expires) {
+			return l
+		}
+		t.remove(l)
+	}
+	l := &lease{id: host.ID}
+	if _, err := io.ReadFull(rand.Reader, l.token[:]); err != nil {
+		return nil
+	}
+	t.leases[l.token] = l
+	t.ids[l.id] = l
+	return l
+}
+
+// release starts the grace period of a lease after its host disconnected.
+func (t *leaseTable) release(l *lease, now time.Time) {
+	l.conn = nil
+	l.expires = now.Add(t.duration)
+}
+
+// expire removes leases whose grace period is over.
+func (t *leaseTable) expire(now time.Time) {
+	for _, l := range t.leases {
+		if l.conn == nil && !now.Before(l.expires) {
+			t.remove(l)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"encoding/gob"
+	"net"
+	"sync"
+
+	"github.com/openclonk/netpuncher"
+)
+
+// PeerRegistry is a Registry shared between netpuncher instances over TCP
+// links. Each instance keeps a copy of all hosts and sends changes to its
+// local hosts to all peers, so every instance has to be linked to every other
+// instance.
+//
+// Links are not authenticated and carry host secrets. Only use them within a
+// trusted network.
+//
+// Two instances registering the same ID at the same time is not detected.
+// With random 32 bit IDs, this is very unlikely.
+type PeerRegistry struct {
+	mu      sync.Mutex
+	local   map[uint32]HostInfo
+	remote  map[uint32]remoteHost
+	links   map[*peerLink]struct{}
+	handler func(id uint32, p Punch)
+	ln      net.Listener
+	closed  bool
+}
+
+type remoteHost struct {
+	info HostInfo
+	link *peerLink // link to the instance the host is connected to
+}
+
+type peerOp byte
+
+const (
+	peerRegister peerOp = iota + 1
+	peerUnregister
+	peerCReq
+)
+
+// Message sent over peer links.
+type peerMsg struct {
+	Op     peerOp
+	ID     uint32
+	Addr   *net.UDPAddr           // peerRegister only
+	Secret *netpuncher.HostSecret // peerRegister only
+	Punch  Punch                  // peerCReq only
+}
+
+func registerMsg(host HostInfo) peerMsg {
+	return peerMsg{Op: peerRegister, ID: host.ID, Addr: host.Addr, Secret: host.Secret}
+}
+
+// peerLink is a connection to another instance. Outgoing messages are queued
+// so that sending never blocks while holding the registry's lock.
+type peerLink struct {
+	conn      net.Conn
+	mu        sync.Mutex
+	queue     []peerMsg
+	wake      chan struct{}
+	quit      chan struct{}
+	closeonce sync.Once
+}
+
+func (l *peerLink) send(m peerMsg) {
+	l.mu.Lock()
+	l.queue = append(l.queue, m)
+	l.mu.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (l *peerLink) close() {
+	l.closeonce.Do(func() {
+		close(l.quit)
+		l.conn.Close()
+	})
+}
+
+// writeLoop sends queued messages until the link closes.
+func (l *peerLink) writeLoop(r *PeerRegistry) {
+	enc := gob.NewEncoder(l.conn)
+	for {
+		select {
+		case <-l.wake:
+		case <-l.quit:
+			return
+		}
+		l.mu.Lock()
+		queue := l.queue
+		l.queue = nil
+		l.mu.Unlock()
+		for i := range queue {
+			if err := enc.Encode(&queue[i]); err != nil {
+				r.removeLink(l)
+				return
+			}
+		}
+	}
+}
+
+// readLoop handles incoming messages until the link closes.
+func (l *peerLink) readLoop(r *PeerRegistry) {
+	dec := gob.NewDecoder(l.conn)
+	for {
+		var m peerMsg
+		if err := dec.Decode(&m); err != nil {
+			r.removeLink(l)
+			return
+		}
+		r.handleMsg(l, m)
+	}
+}
+
+func NewPeerRegistry() *PeerRegistry {
+	return &PeerRegistry{
+		local:  make(map[uint32]HostInfo),
+		remote: make(map[uint32]remoteHost),
+		links:  make(map[*peerLink]struct{}),
+	}
+}
+
+// Listen accepts links from other instances.
+func (r *PeerRegistry) Listen(network, addr string) error {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.ln = ln
+	r.mu.Unlock()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r.addLink(conn)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address Listen accepts links on.
+func (r *PeerRegistry) Addr() net.Addr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ln == nil {
+		return nil
+	}
+	return r.ln.Addr()
+}
+
+// Connect establishes a link to another instance.
+func (r *PeerRegistry) Connect(network, addr string) error {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return err
+	}
+	r.addLink(conn)
+	return nil
+}
+
+func (r *PeerRegistry) addLink(conn net.Conn) {
+	l := &peerLink{
+		conn: conn,
+		wake: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+	}
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		conn.Close()
+		return
+	}
+	r.links[l] = struct{}{}
+	// Tell the peer about all our hosts.
+	for _, host := range r.local {
+		l.send(registerMsg(host))
+	}
+	r.mu.Unlock()
+	go l.writeLoop(r)
+	go l.readLoop(r)
+}
+
+// removeLink closes a link and forgets the hosts of the peer.
+func (r *PeerRegistry) removeLink(l *peerLink) {
+	r.mu.Lock()
+	delete(r.links, l)
+	for id, host := range r.remote {
+		if host.link == l {
+			delete(r.remote, id)
+		}
+	}
+	r.mu.Unlock()
+	l.close()
+}
+
+func (r *PeerRegistry) handleMsg(l *peerLink, m peerMsg) {
+	r.mu.Lock()
+	switch m.Op {
+	case peerRegister:
+		// Local hosts win conflicts.
+		if _, ok := r.local[m.ID]; !ok {
+			r.remote[m.ID] = remoteHost{HostInfo{ID: m.ID, Addr: m.Addr, Secret: m.Secret}, l}
+		}
+	case peerUnregister:
+		if host, ok := r.remote[m.ID]; ok && host.link == l {
+			delete(r.remote, m.ID)
+		}
+	case peerCReq:
+		_, ok := r.local[m.ID]
+		handler := r.handler
+		r.mu.Unlock()
+		if ok && handler != nil {
+			handler(m.ID, m.Punch)
+		}
+		return
+	}
+	r.mu.Unlock()
+}
+
+// broadcast sends a message to all peers. The caller must hold r.mu.
+func (r *PeerRegistry) broadcast(m peerMsg) {
+	for l := range r.links {
+		l.send(m)
+	}
+}
+
+func (r *PeerRegistry) Register(host HostInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.remote[host.ID]; ok {
+		return ErrIDTaken
+	}
+	r.local[host.ID] = host
+	r.broadcast(registerMsg(host))
+	return nil
+}
+
+func (r *PeerRegistry) Unregister(id uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.local[id]; ok {
+		delete(r.local, id)
+		r.broadcast(peerMsg{Op: peerUnregister, ID: id})
+	}
+}
+
+func (r *PeerRegistry) Lookup(id uint32) (HostInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if host, ok := r.local[id]; ok {
+		return host, true
+	}
+	host, ok := r.remote[id]
+	return host.info, ok
+}
+
+func (r *PeerRegistry) DeliverCReq(id uint32, p Punch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	host, ok := r.remote[id]
+	if !ok {
+		return ErrUnknownHost
+	}
+	host.link.send(peerMsg{Op: peerCReq, ID: id, Punch: p})
+	return nil
+}
+
+func (r *PeerRegistry) Handle(f func(id uint32, p Punch)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handler = f
+}
+
+// Close stops accepting links and closes all existing links.
+func (r *PeerRegistry) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	ln := r.ln
+	links := make([]*peerLink, 0, len(r.links))
+	for l := range r.links {
+		links = append(links, l)
+	}
+	r.mu.Unlock()
+	var err error
+	if ln != nil {
+		err = ln.Close()
+	}
+	for _, l := range links {
+		r.removeLink(l)
+	}
+	return err
+}
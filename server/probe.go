@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/openclonk/netpuncher"
+	"github.com/openclonk/netpuncher/c4netioudp"
+)
+
+// Time a connection to the probe listener stays open
+const probeTimeout = 10 * time.Second
+
+type probeReq struct {
+	conn  *c4netioudp.Conn
+	req   *netpuncher.NATProbeReq
+	probe *c4netioudp.Listener // secondary listener for requests on the main listener
+}
+
+// probe handles a NAT probe in the main loop, which owns the rate limiter.
+// Every probe on the main listener makes the probe listener send a plain UDP
+// packet, so probes have to be limited like other requests.
+func (s *Server) probe(r probeReq, st *state) {
+	addr := r.conn.RemoteAddr()
+	if limit, ok := st.limiter.allowProbe(addr, time.Now()); !ok {
+		if s.RateLimited != nil {
+			s.RateLimited(addr, limit)
+		}
+		nack := netpuncher.NAck{
+			Header:  r.req.Header.Negotiate(s.capabilities()),
+			Request: netpuncher.PID_Puncher_NATProbeReq,
+			Reason:  netpuncher.NAckRateLimited,
+		}
+		buf, err := nack.MarshalBinary()
+		if err != nil {
+			if s.MarshalErr != nil {
+				s.MarshalErr(fmt.Errorf("NAck.MarshalBinary(): %v", err))
+			}
+			return
+		}
+		r.conn.Write(buf)
+		return
+	}
+	s.answerProbe(r.conn, r.req, r.probe)
+}
+
+// answerProbe replies to a NAT probe received on conn. If probe is set, the
+// reply announces its address and is sent from there as plain UDP packet as
+// well.
+func (s *Server) answerProbe(conn *c4netioudp.Conn, req *netpuncher.NATProbeReq, probe *c4netioudp.Listener) {
+	addr := conn.RemoteAddr().(*net.UDPAddr)
+	resp := netpuncher.NATProbeResp{
+		Header: req.Header.Negotiate(s.capabilities()),
+		Nonce:  req.Nonce,
+		Addr:   *addr,
+	}
+	if probe != nil {
+		resp.ProbeAddr = *probe.Addr().(*net.UDPAddr)
+	}
+	buf, err := resp.MarshalBinary()
+	if err != nil {
+		if s.MarshalErr != nil {
+			s.MarshalErr(fmt.Errorf("NATProbeResp.MarshalBinary(): %v", err))
+		}
+		return
+	}
+	conn.Write(buf)
+	if probe != nil {
+		// The peer is verified by the C4NetIOUDP handshake, so this can't
+		// be used to send packets to somebody else.
+		probe.WriteTo(buf, addr)
+	}
+	if s.NATProbe != nil {
+		s.NATProbe(addr)
+	}
+}
+
+// serveProbes answers NAT probes on the probe listener until it is closed.
+func (s *Server) serveProbes(listener *c4netioudp.Listener) {
+	defer s.acceptwg.Done()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.AcceptConn()
+		select {
+		case <-s.exitch:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		default:
+		}
+		if err != nil {
+			if s.ProbeErr != nil {
+				s.ProbeErr(err)
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			// Closing the listener on Shutdown closes the connection.
+			conn.SetReadDeadline(time.Now().Add(probeTimeout))
+			for {
+				data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if req, ok := decodeProbe(data); ok {
+					select {
+					case s.probech <- probeReq{conn, req, nil}:
+					case <-s.exitch:
+						return
+					}
+				}
+			}
+		}()
+	}
+}
+
+// decodeProbe decodes a NATProbeReq, other messages are ignored.
+func decodeProbe(data []byte) (*netpuncher.NATProbeReq, bool) {
+	msg, err := netpuncher.Decode(data)
+	if err != nil {
+		return nil, false
+	}
+	req, ok := msg.(*netpuncher.NATProbeReq)
+	return req, ok
+}
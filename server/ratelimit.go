@@ -0,0 +1,180 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// RateLimit configures a token bucket: Rate events per second on average,
+// with bursts of up to Burst events. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits configures the limits the server enforces. Each one is
+// optional.
+type RateLimits struct {
+	ConnsPerIP     RateLimit // new connections per source IP
+	Conns          RateLimit // new connections in total
+	PunchesPerIP   RateLimit // SReq/SReqTCP messages per source IP
+	PunchesPerHost RateLimit // SReq/SReqTCP messages per registered host
+	Punches        RateLimit // SReq/SReqTCP messages in total
+	ProbesPerIP    RateLimit // NATProbeReq messages per source IP
+}
+
+// Limit names a rate limit in RateLimits.
+type Limit string
+
+const (
+	LimitConnsPerIP     Limit = "conns_per_ip"
+	LimitConns          Limit = "conns"
+	LimitPunchesPerIP   Limit = "punches_per_ip"
+	LimitPunchesPerHost Limit = "punches_per_host"
+	LimitPunches        Limit = "punches"
+	LimitProbesPerIP    Limit = "probes_per_ip"
+)
+
+// Interval for removing idle buckets.
+const bucketPruneInterval = 1 * time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time // time of the last refill
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// refill adds the tokens accumulated since the last refill.
+func (b *bucket) refill(l RateLimit, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = l.burst()
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * l.Rate
+		if b.tokens > l.burst() {
+			b.tokens = l.burst()
+		}
+	}
+	b.last = now
+}
+
+// bucketMap holds one bucket per key. Global limits use the empty key.
+type bucketMap struct {
+	limit   RateLimit
+	buckets map[string]*bucket
+}
+
+func newBucketMap(limit RateLimit) *bucketMap {
+	return &bucketMap{limit: limit, buckets: make(map[string]*bucket)}
+}
+
+// get returns the refilled bucket for key, or nil if the limit is disabled.
+func (m *bucketMap) get(key string, now time.Time) *bucket {
+	if m.limit.Rate <= 0 {
+		return nil
+	}
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{}
+		m.buckets[key] = b
+	}
+	b.refill(m.limit, now)
+	return b
+}
+
+// prune removes full buckets, which behave just like new ones.
+func (m *bucketMap) prune(now time.Time) {
+	for key, b := range m.buckets {
+		b.refill(m.limit, now)
+		if b.tokens >= m.limit.burst() {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// rateLimiter enforces RateLimits. It is only used from the server's main
+// loop.
+type rateLimiter struct {
+	connsPerIP, conns                     *bucketMap
+	punchesPerIP, punchesPerHost, punches *bucketMap
+	probesPerIP                           *bucketMap
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{
+		connsPerIP:     newBucketMap(limits.ConnsPerIP),
+		conns:          newBucketMap(limits.Conns),
+		punchesPerIP:   newBucketMap(limits.PunchesPerIP),
+		punchesPerHost: newBucketMap(limits.PunchesPerHost),
+		punches:        newBucketMap(limits.Punches),
+		probesPerIP:    newBucketMap(limits.ProbesPerIP),
+	}
+}
+
+type limitedBucket struct {
+	limit Limit
+	b     *bucket
+}
+
+// take removes a token from each bucket if all of them have one left.
+// Otherwise, it returns the first exceeded limit.
+func take(buckets ...limitedBucket) (Limit, bool) {
+	for _, lb := range buckets {
+		if lb.b != nil && lb.b.tokens < 1 {
+			return lb.limit, false
+		}
+	}
+	for _, lb := range buckets {
+		if lb.b != nil {
+			lb.b.tokens--
+		}
+	}
+	return "", true
+}
+
+func ipKey(addr net.Addr) string {
+	if udpaddr, ok := addr.(*net.UDPAddr); ok {
+		return udpaddr.IP.String()
+	}
+	return addr.String()
+}
+
+// allowConn checks the limits for a new connection from addr.
+func (r *rateLimiter) allowConn(addr net.Addr, now time.Time) (Limit, bool) {
+	return take(
+		limitedBucket{LimitConns, r.conns.get("", now)},
+		limitedBucket{LimitConnsPerIP, r.connsPerIP.get(ipKey(addr), now)},
+	)
+}
+
+// allowPunch checks the limits for a punch request from addr for host id.
+// The per-host limit only applies to registered hosts, so that requests for
+// made-up IDs don't create buckets.
+func (r *rateLimiter) allowPunch(addr net.Addr, id uint32, registered bool, now time.Time) (Limit, bool) {
+	var host *bucket
+	if registered {
+		host = r.punchesPerHost.get(strconv.FormatUint(uint64(id), 10), now)
+	}
+	return take(
+		limitedBucket{LimitPunches, r.punches.get("", now)},
+		limitedBucket{LimitPunchesPerIP, r.punchesPerIP.get(ipKey(addr), now)},
+		limitedBucket{LimitPunchesPerHost, host},
+	)
+}
+
+// allowProbe checks the limits for a NAT probe from addr.
+func (r *rateLimiter) allowProbe(addr net.Addr, now time.Time) (Limit, bool) {
+	return take(limitedBucket{LimitProbesPerIP, r.probesPerIP.get(ipKey(addr), now)})
+}
+
+func (r *rateLimiter) prune(now time.Time) {
+	for _, m := range []*bucketMap{r.connsPerIP, r.conns, r.punchesPerIP, r.punchesPerHost, r.punches, r.probesPerIP} {
+		m.prune(now)
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openclonk/netpuncher"
+	"github.com/openclonk/netpuncher/c4netioudp"
+)
+
+func TestRateLimiter(t *testing.T) {
+	r := newRateLimiter(RateLimits{
+		PunchesPerIP:   RateLimit{Rate: 1, Burst: 2},
+		PunchesPerHost: RateLimit{Rate: 1, Burst: 3},
+	})
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}
+	a2 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 2}
+	b := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1}
+
+	expect := func(addr net.Addr, id uint32, limit Limit, ok bool) {
+		t.Helper()
+		if l, o := r.allowPunch(addr, id, true, now); l != limit || o != ok {
+			t.Errorf("allowPunch(%v, %d) = %q, %v; expected %q, %v", addr, id, l, o, limit, ok)
+		}
+	}
+	// Burst of two per IP, ports don't matter.
+	expect(a, 1, "", true)
+	expect(a2, 1, "", true)
+	expect(a, 1, LimitPunchesPerIP, false)
+	// The host bucket was not drained by the denied request.
+	expect(b, 1, "", true)
+	expect(b, 1, LimitPunchesPerHost, false)
+	expect(b, 2, "", true)
+
+	// Refill after a second.
+	now = now.Add(1 * time.Second)
+	expect(a, 1, "", true)
+	expect(a, 1, LimitPunchesPerIP, false)
+
+	// Unregistered hosts don't get buckets.
+	if l, o := r.allowPunch(b, 3, false, now); l != "" || !o {
+		t.Errorf("allowPunch() for unregistered host = %q, %v", l, o)
+	}
+	if _, ok := r.punchesPerHost.buckets["3"]; ok {
+		t.Error("bucket for unregistered host")
+	}
+
+	// Full buckets are pruned.
+	now = now.Add(1 * time.Minute)
+	r.prune(now)
+	if n := len(r.punchesPerIP.buckets) + len(r.punchesPerHost.buckets); n != 0 {
+		t.Errorf("%d buckets left after pruning", n)
+	}
+	// Disabled limits don't create buckets.
+	r.allowConn(a, now)
+	if n := len(r.connsPerIP.buckets) + len(r.conns.buckets); n != 0 {
+		t.Errorf("%d buckets for disabled limits", n)
+	}
+}
+
+// Punch requests over the limit are answered with a NAck.
+func TestServerRateLimit(t *testing.T) {
+	limited := make(chan Limit, 1)
+	s := Server{
+		RateLimits:  RateLimits{Punches: RateLimit{Rate: 0.001, Burst: 1}},
+		RateLimited: func(addr net.Addr, limit Limit) { limited <- limit },
+	}
+	raddr := listen(t, &s)
+	defer s.Close()
+	hdr := netpuncher.Header{Version: 2}
+	nackHdr := netpuncher.Header{Type: netpuncher.PID_Puncher_NAck, Version: 2}
+
+	client := dial(t, raddr)
+	send(t, client, netpuncher.SReq{Header: hdr, CID: 1337})
+	expected := &netpuncher.NAck{Header: nackHdr, Request: netpuncher.PID_Puncher_SReq, CID: 1337, Reason: netpuncher.NAckUnknownHost}
+	if msg := receive(t, client); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("first request: got %+v, expected %+v", msg, expected)
+	}
+	send(t, client, netpuncher.SReq{Header: hdr, CID: 1337})
+	expected.Reason = netpuncher.NAckRateLimited
+	if msg := receive(t, client); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("second request: got %+v, expected %+v", msg, expected)
+	}
+	if limit := <-limited; limit != LimitPunches {
+		t.Errorf("RateLimited called with %q", limit)
+	}
+}
+
+// A flood of NAT probes gets throttled, so the probe listener doesn't send a
+// plain UDP packet for each of them.
+func TestServerProbeRateLimit(t *testing.T) {
+	probe, err := c4netioudp.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var limited int32
+	s := Server{
+		RateLimits:    RateLimits{ProbesPerIP: RateLimit{Rate: 0.001, Burst: 3}},
+		RateLimited:   func(addr net.Addr, limit Limit) { atomic.AddInt32(&limited, 1) },
+		ProbeListener: probe,
+	}
+	raddr := listen(t, &s)
+	defer s.Close()
+
+	var raw int32
+	lc := c4netioudp.ListenConfig{UnhandledPacket: func(addr *net.UDPAddr, b []byte) {
+		atomic.AddInt32(&raw, 1)
+	}}
+	l, err := lc.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := l.Dial(raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	const probes = 10
+	var answered, nacked int
+	for i := 0; i < probes; i++ {
+		send(t, client, netpuncher.NATProbeReq{Header: netpuncher.Header{Version: 2}, Nonce: uint32(i)})
+		switch msg := receive(t, client).(type) {
+		case *netpuncher.NATProbeResp:
+			answered++
+		case *netpuncher.NAck:
+			if msg.Request != netpuncher.PID_Puncher_NATProbeReq || msg.Reason != netpuncher.NAckRateLimited {
+				t.Errorf("unexpected NAck %+v", msg)
+			}
+			nacked++
+		default:
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	}
+	if answered != 3 || nacked != probes-3 {
+		t.Errorf("%d probes answered, %d rejected", answered, nacked)
+	}
+	if n := atomic.LoadInt32(&limited); n != probes-3 {
+		t.Errorf("RateLimited called %d times", n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&raw); n > 3 {
+		t.Errorf("probe listener sent %d packets", n)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/openclonk/netpuncher"
+)
+
+// HostInfo describes a host registered with a netpuncher instance.
+type HostInfo struct {
+	ID     uint32
+	Addr   *net.UDPAddr           // public address of the host
+	Secret *netpuncher.HostSecret // set if the host requires join tokens
+	Conn   *Conn                  // connection of hosts on this instance, nil for other instances
+}
+
+// Punch asks a host to punch towards a client.
+type Punch struct {
+	ClientAddr net.UDPAddr // public address of the client
+	TCP        bool        // TCP simultaneous open instead of UDP
+	HostPort   int         // TCP port for the host
+	ClientPort int         // TCP port for the client
+}
+
+// A Registry maps host IDs to hosts. Sharing a registry between several
+// netpuncher instances lets them serve one ID space: Clients can connect to
+// any instance to punch towards any host.
+//
+// Registries have to be safe for concurrent use.
+type Registry interface {
+	// Register adds a host connected to this instance, replacing a local
+	// host with the same ID. Fails with ErrIDTaken if a host connected to
+	// another instance has the ID.
+	Register(host HostInfo) error
+	// Unregister removes the local host with the given ID.
+	Unregister(id uint32)
+	// Lookup returns the host with the given ID.
+	Lookup(id uint32) (HostInfo, bool)
+	// DeliverCReq forwards a punch request to the instance the host with
+	// the given ID is connected to.
+	DeliverCReq(id uint32, p Punch) error
+	// Handle sets the function called with punch requests delivered from
+	// other instances.
+	Handle(f func(id uint32, p Punch))
+}
+
+// Returned by Registry.Register if another instance has the ID.
+var ErrIDTaken = errors.New("netpuncher server: ID is taken")
+
+// Returned by Registry.DeliverCReq if the host is unknown.
+var ErrUnknownHost = errors.New("netpuncher server: unknown host")
+
+// MemoryRegistry is the default Registry for a single netpuncher instance.
+type MemoryRegistry struct {
+	mu    sync.Mutex
+	hosts map[uint32]HostInfo
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{hosts: make(map[uint32]HostInfo)}
+}
+
+func (r *MemoryRegistry) Register(host HostInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts[host.ID] = host
+	return nil
+}
+
+func (r *MemoryRegistry) Unregister(id uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.hosts, id)
+}
+
+func (r *MemoryRegistry) Lookup(id uint32) (HostInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	host, ok := r.hosts[id]
+	return host, ok
+}
+
+// All hosts are local, so there is nothing to deliver to.
+func (r *MemoryRegistry) DeliverCReq(id uint32, p Punch) error {
+	return ErrUnknownHost
+}
+
+func (r *MemoryRegistry) Handle(f func(id uint32, p Punch)) {}
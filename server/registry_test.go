@@ -0,0 +1,204 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/openclonk/netpuncher"
+)
+
+// peerServers starts n servers linked by PeerRegistries.
+func peerServers(t *testing.T, n int) []*net.UDPAddr {
+	registries := make([]*PeerRegistry, n)
+	addrs := make([]*net.UDPAddr, n)
+	for i := range registries {
+		r := NewPeerRegistry()
+		if err := r.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		for _, peer := range registries[:i] {
+			if err := r.Connect("tcp", peer.Addr().String()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		t.Cleanup(func() { r.Close() })
+		registries[i] = r
+
+		s := &Server{Registry: r}
+		addrs[i] = listen(t, s)
+		t.Cleanup(func() { s.Close() })
+	}
+	return addrs
+}
+
+// punchUntil sends SReq messages until the answer is not an unknown host NAck,
+// as registrations take a moment to reach other instances.
+func punchUntil(t *testing.T, raddr *net.UDPAddr, sreq netpuncher.SReq) netpuncher.PuncherPacket {
+	client := dial(t, raddr)
+	for i := 0; i < 50; i++ {
+		send(t, client, sreq)
+		msg := receive(t, client)
+		if nack, ok := msg.(*netpuncher.NAck); !ok || nack.Reason != netpuncher.NAckUnknownHost {
+			return msg
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("host did not appear on other instance")
+	return nil
+}
+
+// Clients can punch towards hosts connected to another instance.
+func TestPeerRegistry(t *testing.T) {
+	addrs := peerServers(t, 3)
+	hdr := netpuncher.Header{Version: 2, Caps: netpuncher.CapAuth}
+
+	host := dial(t, addrs[0])
+	assid := requestID(t, host, hdr, netpuncher.ResumeToken{})
+	token := netpuncher.NewJoinToken(assid.Secret, assid.CID)
+
+	for _, raddr := range addrs[1:] {
+		msg := punchUntil(t, raddr, netpuncher.SReq{Header: hdr, CID: assid.CID, Token: token})
+		creq, ok := msg.(*netpuncher.CReq)
+		if !ok {
+			t.Fatalf("expected CReq, got %+v", msg)
+		}
+		if creq.Addr.Port != host.LocalAddr().(*net.UDPAddr).Port {
+			t.Errorf("client got host address %v, expected port of %v", &creq.Addr, host.LocalAddr())
+		}
+		if msg, ok := receive(t, host).(*netpuncher.CReq); !ok {
+			t.Errorf("host expected CReq, got %+v", msg)
+		}
+	}
+
+	// Other instances check join tokens as well.
+	client := dial(t, addrs[1])
+	send(t, client, netpuncher.SReq{Header: hdr, CID: assid.CID})
+	expected := &netpuncher.NAck{
+		Header:  netpuncher.Header{Type: netpuncher.PID_Puncher_NAck, Version: 2, Caps: netpuncher.CapAuth},
+		Request: netpuncher.PID_Puncher_SReq,
+		CID:     assid.CID,
+		Reason:  netpuncher.NAckAuthFailed,
+	}
+	if msg := receive(t, client); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("invalid token: got %+v, expected %+v", msg, expected)
+	}
+
+	// Hosts disappear from other instances when they disconnect.
+	host.Close()
+	expected.Reason = netpuncher.NAckUnknownHost
+	for i := 0; ; i++ {
+		send(t, client, netpuncher.SReq{Header: hdr, CID: assid.CID, Token: token})
+		msg := receive(t, client)
+		if reflect.DeepEqual(msg, expected) {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("host still known after disconnecting, got %+v", msg)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Ports in TCP punch requests forwarded to other instances match.
+func TestPeerRegistryTCP(t *testing.T) {
+	addrs := peerServers(t, 2)
+	hdr := netpuncher.Header{Version: 2}
+
+	host := dial(t, addrs[0])
+	assid := requestID(t, host, hdr, netpuncher.ResumeToken{})
+
+	msg := punchUntil(t, addrs[1], netpuncher.SReq{Header: hdr, CID: assid.CID})
+	if _, ok := msg.(*netpuncher.CReq); !ok {
+		t.Fatalf("expected CReq, got %+v", msg)
+	}
+	receive(t, host)
+
+	client := dial(t, addrs[1])
+	send(t, client, netpuncher.SReqTCP{Header: hdr, CID: assid.CID})
+	ccreq, ok := receive(t, client).(*netpuncher.CReqTCP)
+	if !ok {
+		t.Fatal("client expected CReqTCP")
+	}
+	hcreq, ok := receive(t, host).(*netpuncher.CReqTCP)
+	if !ok {
+		t.Fatal("host expected CReqTCP")
+	}
+	if ccreq.SourceAddr.Port != hcreq.DestAddr.Port || ccreq.DestAddr.Port != hcreq.SourceAddr.Port {
+		t.Errorf("ports don't match: client %+v, host %+v", ccreq, hcreq)
+	}
+}
+
+// Hosts on other instances keep their IDs.
+func TestPeerRegistryIDTaken(t *testing.T) {
+	a, b := NewPeerRegistry(), NewPeerRegistry()
+	defer a.Close()
+	defer b.Close()
+	if err := a.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Register(HostInfo{ID: 42, Addr: &net.UDPAddr{}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Connect("tcp", a.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if _, ok := b.Lookup(42); ok {
+			break
+		}
+		if i == 50 {
+			t.Fatal("host did not appear on other instance")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := b.Register(HostInfo{ID: 42}); err != ErrIDTaken {
+		t.Errorf("Register() = %v, expected ErrIDTaken", err)
+	}
+
+	// Hosts of a peer are forgotten when the link closes.
+	a.Close()
+	for i := 0; ; i++ {
+		if _, ok := b.Lookup(42); !ok {
+			break
+		}
+		if i == 50 {
+			t.Fatal("host still known after link closed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// failingRegistry refuses all hosts.
+type failingRegistry struct {
+	*MemoryRegistry
+}
+
+var errRegistryDown = errors.New("registry down")
+
+func (failingRegistry) Register(host HostInfo) error { return errRegistryDown }
+
+// Registry failures are reported and leave the host without an ID.
+func TestRegisterErr(t *testing.T) {
+	errs := make(chan error, 1)
+	s := Server{
+		Registry:    failingRegistry{NewMemoryRegistry()},
+		RegisterErr: func(host *Conn, err error) { errs <- err },
+		MarshalErr:  func(err error) { t.Errorf("MarshalErr: %v", err) },
+	}
+	raddr := listen(t, &s)
+	defer s.Close()
+
+	host := dial(t, raddr)
+	send(t, host, netpuncher.IDReq{Header: netpuncher.Header{Version: 2}})
+	select {
+	case err := <-errs:
+		if err != errRegistryDown {
+			t.Errorf("RegisterErr: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("RegisterErr not called")
+	}
+}
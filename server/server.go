@@ -1,9 +1,13 @@
 package server
 
 import (
+	"context"
+	crand "crypto/rand"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/openclonk/netpuncher"
@@ -13,17 +17,57 @@ import (
 type Conn struct {
 	ID        uint32
 	NetIOConn *c4netioudp.Conn
-	version   netpuncher.ProtocolVersion
+	hdr       netpuncher.Header      // negotiated protocol version and capabilities, written by the main loop
+	hdrmu     sync.Mutex             // protects hdr
+	lease     *lease                 // host ID lease, only used from the main loop
+	secret    *netpuncher.HostSecret // set if the host requires join tokens
 	s         *Server
 }
 
 func (c *Conn) npHeader() netpuncher.Header {
-	return netpuncher.Header{Version: c.version}
+	c.hdrmu.Lock()
+	defer c.hdrmu.Unlock()
+	return c.hdr
 }
 
-func (c *Conn) handlePackets(req chan<- punchReq, close chan<- uint32) {
+// nack rejects a request of the peer. Peers using protocol version 1 don't
+// know NAck messages and are left waiting.
+func (c *Conn) nack(request byte, cid uint32, reason netpuncher.NAckReason) {
+	hdr := c.npHeader()
+	if hdr.Version < 2 {
+		return
+	}
+	c.sendNAck(hdr, request, cid, reason)
+}
+
+func (c *Conn) sendNAck(hdr netpuncher.Header, request byte, cid uint32, reason netpuncher.NAckReason) {
+	buf, err := netpuncher.NAck{Header: hdr, Request: request, CID: cid, Reason: reason}.MarshalBinary()
+	if err != nil {
+		if c.s.MarshalErr != nil {
+			c.s.MarshalErr(fmt.Errorf("NAck.MarshalBinary(): %v", err))
+		}
+		return
+	}
+	c.NetIOConn.Write(buf)
+}
+
+// negotiate updates the protocol version and capabilities used for talking to
+// the peer from the header of a request. Only the main loop calls this, so
+// that the header stays the same while it handles a request.
+func (c *Conn) negotiate(h netpuncher.Header) {
+	c.hdrmu.Lock()
+	c.hdr = h.Negotiate(c.s.capabilities())
+	c.hdrmu.Unlock()
+}
+
+func (c *Conn) handlePackets(req chan<- punchReq, hostreq chan<- hostReq, close chan<- *Conn) {
+	defer c.s.wg.Done()
 	for {
-		msg, err := netpuncher.ReadFrom(c.NetIOConn)
+		var msg netpuncher.PuncherPacket
+		data, err := c.NetIOConn.ReadMessage()
+		if err == nil {
+			msg, err = netpuncher.Decode(data)
+		}
 		select {
 		case <-c.s.exitch:
 			return
@@ -35,12 +79,17 @@ func (c *Conn) handlePackets(req chan<- punchReq, close chan<- uint32) {
 				c.s.CloseConn(c, &errt)
 			}
 			c.NetIOConn.Close()
-			close <- c.ID
+			select {
+			case close <- c:
+			case <-c.s.exitch:
+			}
 			return
 		case netpuncher.ErrUnsupportedVersion:
 			if c.s.UnsupportedVersionErr != nil {
 				c.s.UnsupportedVersionErr(c, &errt)
 			}
+			// The peer speaks a newer version, tell it which one we support.
+			c.sendNAck(netpuncher.Header{Version: netpuncher.NewestProtocolVersion}, 0, 0, netpuncher.NAckUnsupportedVersion)
 			c.NetIOConn.Close()
 			continue
 		case nil: // ok
@@ -48,36 +97,76 @@ func (c *Conn) handlePackets(req chan<- punchReq, close chan<- uint32) {
 			if c.s.InvalidPacketErr != nil {
 				c.s.InvalidPacketErr(c, err)
 			}
+			var request byte
+			if t, ok := err.(netpuncher.ErrUnknownType); ok {
+				request = byte(t)
+			}
+			c.nack(request, 0, netpuncher.NAckInvalidMessage)
 			continue
 		}
 		switch np := msg.(type) {
 		case *netpuncher.IDReq:
-			c.version = np.Header.Version
-			buf, err := netpuncher.AssID{Header: c.npHeader(), CID: c.ID}.MarshalBinary()
-			if err != nil {
-				if c.s.MarshalErr != nil {
-					c.s.MarshalErr(fmt.Errorf("AssID.MarshalBinary(): %v", err))
-				}
-				continue
+			// The main loop may change c.ID, wait for it to finish.
+			done := make(chan struct{})
+			select {
+			case hostreq <- hostReq{c, np.Header, np.ResumeToken, done}:
+			case <-c.s.exitch:
+				return
 			}
-			c.NetIOConn.Write(buf)
-			if c.s.RegisterHost != nil {
-				c.s.RegisterHost(c)
+			select {
+			case <-done:
+			case <-c.s.exitch:
+				return
 			}
 		case *netpuncher.SReq:
-			c.version = np.Header.Version
-			req <- punchReq{np.CID, c, false}
+			select {
+			case req <- punchReq{np.CID, c, np.Header, false, np.Token}:
+			case <-c.s.exitch:
+				return
+			}
 		case *netpuncher.SReqTCP:
-			c.version = np.Header.Version
-			req <- punchReq{np.CID, c, true}
+			select {
+			case req <- punchReq{np.CID, c, np.Header, true, np.Token}:
+			case <-c.s.exitch:
+				return
+			}
+		case *netpuncher.NATProbeReq:
+			select {
+			case c.s.probech <- probeReq{c.NetIOConn, np, c.s.ProbeListener}:
+			case <-c.s.exitch:
+				return
+			}
 		}
 	}
 }
 
 type punchReq struct {
-	id   uint32
-	conn *Conn
-	tcp  bool
+	id    uint32
+	conn  *Conn
+	hdr   netpuncher.Header // header of the request, for negotiation
+	tcp   bool
+	token netpuncher.JoinToken
+}
+
+// msgType returns the type of the request message.
+func (r punchReq) msgType() byte {
+	if r.tcp {
+		return netpuncher.PID_Puncher_SReqTCP
+	}
+	return netpuncher.PID_Puncher_SReq
+}
+
+// remotePunch is a punch request delivered from another instance.
+type remotePunch struct {
+	id uint32
+	p  Punch
+}
+
+type hostReq struct {
+	conn  *Conn
+	hdr   netpuncher.Header // header of the request, for negotiation
+	token netpuncher.ResumeToken
+	done  chan<- struct{} // closed after handling the request
 }
 
 type Server struct {
@@ -86,11 +175,299 @@ type Server struct {
 	UnsupportedVersionErr func(c *Conn, err *netpuncher.ErrUnsupportedVersion) // called when a client sends a packet with an unsupported version
 	InvalidPacketErr      func(c *Conn, err error)                             // called when a client sends an invalid packet
 	RegisterHost          func(host *Conn)                                     // called when a host requests an ID
+	RegisterErr           func(host *Conn, err error)                          // called when a host can't be registered
 	CReq                  func(host *Conn, client *Conn)                       // called when initiating punch between host and client
+	ForwardCReq           func(host HostInfo, client *Conn)                    // called when initiating punch with a host on another instance
+	RemoteCReq            func(host *Conn, p Punch)                            // called when initiating punch for a client on another instance
 	CloseConn             func(c *Conn, err *c4netioudp.ErrConnectionClosed)   // called when closing a connection
+	AuthFailed            func(client *Conn, id uint32)                        // called when a client has no valid join token for a host
+	UnknownHost           func(client *Conn, id uint32)                        // called when a client requests punching for an unknown host ID
+	RateLimited           func(addr net.Addr, limit Limit)                     // called when dropping a connection or punch request from addr
+	NATProbe              func(addr net.Addr)                                  // called when answering a NAT probe from addr
+	AllocErr              func(addr net.Addr, err error)                       // called when refusing a connection from addr because no ID could be allocated
+	ProbeErr              func(err error)                                      // called when accepting a connection on the ProbeListener fails
+
+	// Time a host ID stays reserved after the host disconnected. A host
+	// reconnecting within this time gets its ID back if it sends the
+	// ResumeToken from its AssID message. Zero disables leases.
+	LeaseDuration time.Duration
+
+	// Assigns IDs to new connections. Defaults to RandomIDAllocator.
+	IDAllocator IDAllocator
+
+	// Limits for new connections and punch requests.
+	RateLimits RateLimits
+
+	// Limits for connections and handshakes in progress on the UDP socket.
+	ListenConfig c4netioudp.ListenConfig
+
+	// Secondary listener for NAT probes, optional. It should listen on a
+	// different port and ideally on a different IP than the main listener.
+	// The server answers NATProbeReq messages on both listeners and
+	// additionally sends answers from the main listener as plain UDP
+	// packets from this one, see messages.go. The server closes it on
+	// Shutdown.
+	ProbeListener *c4netioudp.Listener
+
+	// Keeps track of hosts. Share a registry between several instances to
+	// let clients punch towards hosts connected to any of them. Defaults to
+	// a MemoryRegistry.
+	Registry Registry
 
 	listener *c4netioudp.Listener
-	exitch   chan struct{} // signals that the server should exit
+	probech  chan probeReq  // NAT probes for the main loop
+	exitch   chan struct{}  // signals that the server should exit
+	exitonce sync.Once      // protects closing exitch
+	lclose   sync.Once      // protects closing the listener
+	wg       sync.WaitGroup // main loop and per-connection goroutines
+	acceptwg sync.WaitGroup // accept goroutine, exits when the listener closes
+}
+
+// capabilities returns the optional protocol features the server offers.
+func (s *Server) capabilities() netpuncher.Capabilities {
+	caps := netpuncher.CapAuth
+	if s.LeaseDuration > 0 {
+		caps |= netpuncher.CapResume
+	}
+	return caps
+}
+
+// state is the connection and host state owned by the server's main loop.
+type state struct {
+	conns    map[uint32]*Conn // all connections, by ID
+	leases   *leaseTable
+	limiter  *rateLimiter
+	registry Registry
+	alloc    IDAllocator
+	rng      *rand.Rand // only used for TCP ports, IDs come from alloc
+}
+
+func (st *state) taken(id uint32) bool {
+	return idTaken(st.conns, st.leases, st.registry)(id)
+}
+
+// registered returns whether c is the registered host for its ID.
+func (st *state) registered(c *Conn) bool {
+	host, ok := st.registry.Lookup(c.ID)
+	return ok && host.Conn == c
+}
+
+// setID moves a connection to a different ID.
+func (st *state) setID(c *Conn, id uint32) {
+	if st.registered(c) {
+		st.registry.Unregister(c.ID)
+	}
+	if st.conns[c.ID] == c {
+		delete(st.conns, c.ID)
+	}
+	c.ID = id
+	st.conns[id] = c
+	if c.lease != nil && c.lease.id != id {
+		st.leases.move(c.lease, id)
+	}
+}
+
+// register adds a host to the registry. If a host on another instance has
+// the same ID, the host moves to a new ID.
+func (s *Server) register(c *Conn, st *state) error {
+	for i := 0; ; i++ {
+		err := st.registry.Register(HostInfo{
+			ID:     c.ID,
+			Addr:   c.NetIOConn.RemoteAddr().(*net.UDPAddr),
+			Secret: c.secret,
+			Conn:   c,
+		})
+		if err != ErrIDTaken || i == maxAllocAttempts {
+			return err
+		}
+		id, err := st.alloc.AllocateID(st.taken)
+		if err != nil {
+			return err
+		}
+		st.setID(c, id)
+	}
+}
+
+// registerHost assigns an ID to a host, resuming a previous lease if
+// possible, and replies with an AssID message.
+func (s *Server) registerHost(r hostReq, st *state) {
+	defer close(r.done)
+	c := r.conn
+	c.negotiate(r.hdr)
+	if c.hdr.Caps.Has(netpuncher.CapResume) {
+		l := c.lease
+		if l == nil {
+			l = st.leases.acquire(c, r.token, time.Now())
+		}
+		if l != nil && l.conn != c {
+			if old := l.conn; old != nil {
+				// The host reconnected before the old connection timed out.
+				old.lease = nil
+				old.NetIOConn.Close()
+			}
+			l.conn = c
+			c.lease = l
+			st.setID(c, l.id)
+		}
+	}
+	c.secret = nil
+	if c.hdr.Caps.Has(netpuncher.CapAuth) {
+		// Resumed hosts keep their secret so that handed out join tokens
+		// stay valid.
+		if c.lease != nil {
+			c.secret = c.lease.secret
+		}
+		if c.secret == nil {
+			c.secret = new(netpuncher.HostSecret)
+			if _, err := io.ReadFull(crand.Reader, c.secret[:]); err != nil {
+				c.secret = nil
+				if s.RegisterErr != nil {
+					s.RegisterErr(c, fmt.Errorf("couldn't generate secret: %v", err))
+				}
+				return
+			}
+		}
+		if c.lease != nil {
+			c.lease.secret = c.secret
+		}
+	}
+	if err := s.register(c, st); err != nil {
+		if s.RegisterErr != nil {
+			s.RegisterErr(c, err)
+		}
+		return
+	}
+	assid := netpuncher.AssID{Header: c.npHeader(), CID: c.ID}
+	// Tell the host its public address (only sent with version 2).
+	assid.Addr = *c.NetIOConn.RemoteAddr().(*net.UDPAddr)
+	if c.lease != nil && c.hdr.Caps.Has(netpuncher.CapResume) {
+		assid.ResumeToken = c.lease.token
+	}
+	if c.secret != nil {
+		assid.Secret = *c.secret
+	}
+	buf, err := assid.MarshalBinary()
+	if err != nil {
+		if s.MarshalErr != nil {
+			s.MarshalErr(fmt.Errorf("AssID.MarshalBinary(): %v", err))
+		}
+		return
+	}
+	c.NetIOConn.Write(buf)
+	if s.RegisterHost != nil {
+		s.RegisterHost(c)
+	}
+}
+
+// punch handles a punch request: The client (r.conn) requests punching from
+// the host (r.id). We will send a CReq message to both parties. If the host is
+// connected to another instance, that instance sends the host's CReq.
+func (s *Server) punch(r punchReq, st *state) {
+	client := r.conn
+	client.negotiate(r.hdr)
+	host, ok := st.registry.Lookup(r.id)
+	// Every CReq makes us send a packet to the host. Limit this to prevent
+	// abuse of the netpuncher for flooding hosts.
+	if limit, allowed := st.limiter.allowPunch(client.NetIOConn.RemoteAddr(), r.id, ok, time.Now()); !allowed {
+		client.nack(r.msgType(), r.id, netpuncher.NAckRateLimited)
+		if s.RateLimited != nil {
+			s.RateLimited(client.NetIOConn.RemoteAddr(), limit)
+		}
+		return
+	}
+	if !ok {
+		s.unknownHost(r)
+		return
+	}
+	if host.Secret != nil && !r.token.Valid(*host.Secret, r.id) {
+		client.nack(r.msgType(), r.id, netpuncher.NAckAuthFailed)
+		if s.AuthFailed != nil {
+			s.AuthFailed(client, r.id)
+		}
+		return
+	}
+	caddr := client.NetIOConn.RemoteAddr().(*net.UDPAddr)
+	p := Punch{ClientAddr: *caddr, TCP: r.tcp}
+	if r.tcp {
+		p.HostPort = randomPort(st.rng)
+		p.ClientPort = randomPort(st.rng)
+	}
+	if host.Conn != nil {
+		if !s.sendHostCReq(host.Conn, p) {
+			return
+		}
+	} else if err := st.registry.DeliverCReq(r.id, p); err != nil {
+		// The host disconnected from the other instance in the meantime.
+		s.unknownHost(r)
+		return
+	}
+	var cbuf []byte
+	var err error
+	if r.tcp {
+		cbuf, err = netpuncher.CReqTCP{
+			Header:     client.npHeader(),
+			SourceAddr: net.TCPAddr{IP: caddr.IP, Port: p.ClientPort},
+			DestAddr:   net.TCPAddr{IP: host.Addr.IP, Port: p.HostPort}}.MarshalBinary()
+	} else {
+		cbuf, err = netpuncher.CReq{Header: client.npHeader(), Addr: *host.Addr}.MarshalBinary()
+	}
+	if err != nil {
+		if s.MarshalErr != nil {
+			s.MarshalErr(fmt.Errorf("CReq.MarshalBinary() client: %v", err))
+		}
+		return
+	}
+	client.NetIOConn.Write(cbuf)
+	if host.Conn == nil {
+		if s.ForwardCReq != nil {
+			s.ForwardCReq(host, client)
+		}
+	} else if s.CReq != nil {
+		s.CReq(host.Conn, client)
+	}
+}
+
+func (s *Server) unknownHost(r punchReq) {
+	r.conn.nack(r.msgType(), r.id, netpuncher.NAckUnknownHost)
+	if s.UnknownHost != nil {
+		s.UnknownHost(r.conn, r.id)
+	}
+}
+
+// sendHostCReq sends the host's CReq message for a punch request. Returns
+// false if marshalling failed.
+func (s *Server) sendHostCReq(host *Conn, p Punch) bool {
+	haddr := host.NetIOConn.RemoteAddr().(*net.UDPAddr)
+	var buf []byte
+	var err error
+	if p.TCP {
+		buf, err = netpuncher.CReqTCP{
+			Header:     host.npHeader(),
+			SourceAddr: net.TCPAddr{IP: haddr.IP, Port: p.HostPort},
+			DestAddr:   net.TCPAddr{IP: p.ClientAddr.IP, Port: p.ClientPort}}.MarshalBinary()
+	} else {
+		buf, err = netpuncher.CReq{Header: host.npHeader(), Addr: p.ClientAddr}.MarshalBinary()
+	}
+	if err != nil {
+		if s.MarshalErr != nil {
+			s.MarshalErr(fmt.Errorf("CReq.MarshalBinary() host: %v", err))
+		}
+		return false
+	}
+	host.NetIOConn.Write(buf)
+	return true
+}
+
+// idTaken returns a function reporting whether an ID belongs to a connection,
+// a lease or a host on another instance.
+func idTaken(conns map[uint32]*Conn, leases *leaseTable, registry Registry) func(id uint32) bool {
+	return func(id uint32) bool {
+		if _, ok := conns[id]; ok || leases.reserved(id) {
+			return true
+		}
+		_, ok := registry.Lookup(id)
+		return ok
+	}
 }
 
 // randomPort generates a random dynamic port.
@@ -102,25 +479,73 @@ func randomPort(rng *rand.Rand) int {
 
 // Listen starts the netpuncher server.
 func (s *Server) Listen(network string, listenaddr *net.UDPAddr) error {
-	listener, err := c4netioudp.Listen(network, listenaddr)
+	listener, err := s.ListenConfig.Listen(network, listenaddr)
 	if err != nil {
 		return fmt.Errorf("couldn't ListenUDP: %v", err)
 	}
+	return s.Serve(listener)
+}
+
+// Serve starts the netpuncher server on an existing listener, for example one
+// created with ListenConfig.ListenPacket. The server closes the listener on
+// Shutdown. s.ListenConfig is ignored.
+func (s *Server) Serve(listener *c4netioudp.Listener) error {
 	s.listener = listener
 	s.exitch = make(chan struct{})
+	s.probech = make(chan probeReq)
+
+	st := &state{
+		conns:    make(map[uint32]*Conn),
+		leases:   newLeaseTable(s.LeaseDuration),
+		limiter:  newRateLimiter(s.RateLimits),
+		registry: s.Registry,
+		alloc:    s.IDAllocator,
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if st.registry == nil {
+		st.registry = NewMemoryRegistry()
+	}
+	if st.alloc == nil {
+		st.alloc = RandomIDAllocator{}
+	}
+	remotech := make(chan remotePunch)
+	st.registry.Handle(func(id uint32, p Punch) {
+		select {
+		case remotech <- remotePunch{id, p}:
+		case <-s.exitch:
+		}
+	})
 
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	if s.ProbeListener != nil {
+		s.acceptwg.Add(1)
+		go s.serveProbes(s.ProbeListener)
+	}
 
+	s.wg.Add(1)
+	s.acceptwg.Add(1)
 	go func() {
+		defer s.wg.Done()
 		connch := make(chan *c4netioudp.Conn)
-		conns := make(map[uint32]*Conn)
 		req := make(chan punchReq)
-		closech := make(chan uint32)
+		hostreq := make(chan hostReq)
+		closech := make(chan *Conn)
+		prunetick := time.NewTicker(bucketPruneInterval)
+		defer prunetick.Stop()
+		var leasetick <-chan time.Time
+		if s.LeaseDuration > 0 {
+			ticker := time.NewTicker(s.LeaseDuration)
+			defer ticker.Stop()
+			leasetick = ticker.C
+		}
 		go func() {
+			defer s.acceptwg.Done()
 			for {
 				conn, err := listener.AcceptConn()
 				select {
 				case <-s.exitch:
+					if conn != nil {
+						conn.Close()
+					}
 					return
 				default:
 				}
@@ -130,64 +555,78 @@ func (s *Server) Listen(network string, listenaddr *net.UDPAddr) error {
 					}
 					continue
 				}
-				connch <- conn
+				select {
+				case connch <- conn:
+				case <-s.exitch:
+					conn.Close()
+					return
+				}
 			}
 		}()
 		for {
 			select {
 			case conn := <-connch:
-				id := rng.Uint32()
+				if limit, ok := st.limiter.allowConn(conn.RemoteAddr(), time.Now()); !ok {
+					conn.Close()
+					if s.RateLimited != nil {
+						s.RateLimited(conn.RemoteAddr(), limit)
+					}
+					continue
+				}
+				id, err := st.alloc.AllocateID(st.taken)
+				if err != nil {
+					conn.Close()
+					if s.AllocErr != nil {
+						s.AllocErr(conn.RemoteAddr(), err)
+					}
+					continue
+				}
 				c := &Conn{ID: id, NetIOConn: conn, s: s}
-				conns[id] = c
-				go c.handlePackets(req, closech)
+				st.conns[id] = c
+				s.wg.Add(1)
+				go c.handlePackets(req, hostreq, closech)
 				if s.AcceptConn != nil {
 					s.AcceptConn(c, nil)
 				}
 			case r := <-req:
-				// The client (r.conn) requests punching from the host (r.id). We will send a
-				// CReq message to both parties.
-				client := r.conn
-				if host, ok := conns[r.id]; ok {
-					caddr := client.NetIOConn.RemoteAddr().(*net.UDPAddr)
-					haddr := host.NetIOConn.RemoteAddr().(*net.UDPAddr)
-					var hbuf, cbuf []byte
-					var herr, cerr error
-					if r.tcp {
-						caddrtcp := net.TCPAddr{IP: caddr.IP, Port: randomPort(rng)}
-						haddrtcp := net.TCPAddr{IP: haddr.IP, Port: randomPort(rng)}
-						hbuf, herr = netpuncher.CReqTCP{
-							Header:     host.npHeader(),
-							SourceAddr: haddrtcp,
-							DestAddr:   caddrtcp}.MarshalBinary()
-						cbuf, cerr = netpuncher.CReqTCP{
-							Header:     client.npHeader(),
-							SourceAddr: caddrtcp,
-							DestAddr:   haddrtcp}.MarshalBinary()
-					} else {
-						hbuf, herr = netpuncher.CReq{Header: host.npHeader(), Addr: *caddr}.MarshalBinary()
-						cbuf, cerr = netpuncher.CReq{Header: client.npHeader(), Addr: *haddr}.MarshalBinary()
-					}
-					if herr != nil {
-						if s.MarshalErr != nil {
-							s.MarshalErr(fmt.Errorf("CReq.MarshalBinary() host: %v", herr))
-						}
-						continue
-					}
-					host.NetIOConn.Write(hbuf)
-					if cerr != nil {
-						if s.MarshalErr != nil {
-							s.MarshalErr(fmt.Errorf("CReq.MarshalBinary() client: %v", cerr))
-						}
-						continue
-					}
-					client.NetIOConn.Write(cbuf)
-					if s.CReq != nil {
-						s.CReq(host, client)
-					}
+				s.punch(r, st)
+			case r := <-hostreq:
+				s.registerHost(r, st)
+			case r := <-s.probech:
+				s.probe(r, st)
+			case r := <-remotech:
+				host, ok := st.registry.Lookup(r.id)
+				if !ok || host.Conn == nil {
+					// The host disconnected in the meantime.
+					continue
 				}
-			case id := <-closech:
-				delete(conns, id)
+				if s.sendHostCReq(host.Conn, r.p) && s.RemoteCReq != nil {
+					s.RemoteCReq(host.Conn, r.p)
+				}
+			case c := <-closech:
+				if st.registered(c) {
+					st.registry.Unregister(c.ID)
+				}
+				if st.conns[c.ID] == c {
+					delete(st.conns, c.ID)
+				}
+				if c.lease != nil {
+					st.leases.release(c.lease, time.Now())
+				}
+			case now := <-leasetick:
+				st.leases.expire(now)
+			case now := <-prunetick.C:
+				st.limiter.prune(now)
 			case <-s.exitch:
+				// Tell everyone that we're going away. Closing the
+				// connections sends an IPID_Close packet and makes the
+				// handlePackets goroutines exit.
+				for _, c := range st.conns {
+					if st.registered(c) {
+						st.registry.Unregister(c.ID)
+					}
+					c.NetIOConn.Close()
+				}
 				return
 			}
 		}
@@ -204,8 +643,43 @@ func (s *Server) Addr() net.Addr {
 	return s.listener.Addr()
 }
 
-// Close makes the netpuncher exit.
+// Shutdown gracefully shuts down the netpuncher: It stops accepting new
+// connections, closes all existing connections (notifying the peers) and
+// waits for all connection goroutines to exit before closing the listener. If
+// ctx expires first, the listener is closed anyway and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.listener == nil {
+		return nil
+	}
+	s.exitonce.Do(func() { close(s.exitch) })
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	s.lclose.Do(func() {
+		if lerr := s.listener.Close(); err == nil {
+			err = lerr
+		}
+		if s.ProbeListener != nil {
+			if lerr := s.ProbeListener.Close(); err == nil {
+				err = lerr
+			}
+		}
+	})
+	s.acceptwg.Wait()
+	return err
+}
+
+// Close makes the netpuncher exit. It is equivalent to calling Shutdown
+// without a deadline.
 func (s *Server) Close() error {
-	close(s.exitch)
-	return nil
+	return s.Shutdown(context.Background())
 }
@@ -0,0 +1,407 @@
+package server
+
+import (
+	"context"
+	"encoding"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/openclonk/netpuncher"
+	"github.com/openclonk/netpuncher/c4netioudp"
+	"github.com/openclonk/netpuncher/c4netioudp/simnet"
+)
+
+// listen starts a server on the loopback interface.
+func listen(t *testing.T, s *Server) *net.UDPAddr {
+	if err := s.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback, Port: 0}); err != nil {
+		t.Fatal(err)
+	}
+	return s.Addr().(*net.UDPAddr)
+}
+
+// dial connects to the server, closing the connection at the end of the test.
+func dial(t *testing.T, raddr *net.UDPAddr) *c4netioudp.Conn {
+	conn, err := c4netioudp.Dial("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// send writes a netpuncher message to conn.
+func send(t *testing.T, conn *c4netioudp.Conn, msg encoding.BinaryMarshaler) {
+	buf, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive reads the next netpuncher message from conn.
+func receive(t *testing.T, conn *c4netioudp.Conn) netpuncher.PuncherPacket {
+	type result struct {
+		msg netpuncher.PuncherPacket
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		msg, err := netpuncher.ReadFrom(conn)
+		ch <- result{msg, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.msg
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+	return nil
+}
+
+// requestID sends an IDReq and returns the server's answer.
+func requestID(t *testing.T, conn *c4netioudp.Conn, hdr netpuncher.Header, token netpuncher.ResumeToken) *netpuncher.AssID {
+	send(t, conn, netpuncher.IDReq{Header: hdr, ResumeToken: token})
+	msg := receive(t, conn)
+	assid, ok := msg.(*netpuncher.AssID)
+	if !ok {
+		t.Fatalf("expected AssID, got %T", msg)
+	}
+	return assid
+}
+
+// sameLease returns whether two AssIDs hand out the same lease. Their
+// addresses differ if the host reconnected.
+func sameLease(a, b *netpuncher.AssID) bool {
+	return a.Header == b.Header && a.CID == b.CID && a.ResumeToken == b.ResumeToken && a.Secret == b.Secret
+}
+
+// simListen creates a listener on a socket behind nat.
+func simListen(t *testing.T, nat *simnet.NAT, laddr *net.UDPAddr) *c4netioudp.Listener {
+	pc, err := nat.ListenPacket(laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := c4netioudp.ListenPacket(pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// simDial connects a listener to the server.
+func simDial(t *testing.T, listener *c4netioudp.Listener, raddr *net.UDPAddr) *c4netioudp.Conn {
+	conn, err := listener.Dial(raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Host and client behind NATs punch through with the server's help.
+func TestServe(t *testing.T) {
+	n := simnet.New(simnet.Config{Seed: 1, Latency: 5 * time.Millisecond, Jitter: 2 * time.Millisecond})
+	raddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 11115}
+	pc, err := n.ListenPacket(raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := c4netioudp.ListenPacket(pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Server{}
+	if err := s.Serve(listener); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	hostNAT := n.NewNAT(net.IPv4(198, 51, 100, 1), simnet.PortRestrictedCone)
+	clientNAT := n.NewNAT(net.IPv4(203, 0, 113, 1), simnet.PortRestrictedCone)
+	hostl := simListen(t, hostNAT, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 11112})
+	clientl := simListen(t, clientNAT, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 11112})
+	host := simDial(t, hostl, raddr)
+	client := simDial(t, clientl, raddr)
+
+	hdr := netpuncher.Header{Version: 2}
+	assid := requestID(t, host, hdr, netpuncher.ResumeToken{})
+	// The host learns its public address.
+	if !assid.Addr.IP.Equal(net.IPv4(198, 51, 100, 1)) || assid.Addr.String() != host.ExternalAddr().String() {
+		t.Errorf("AssID address %v, connection has %v", &assid.Addr, host.ExternalAddr())
+	}
+	send(t, client, netpuncher.SReq{Header: hdr, CID: assid.CID})
+	creqs := make([]*netpuncher.CReq, 2)
+	for i, conn := range []*c4netioudp.Conn{host, client} {
+		msg, ok := receive(t, conn).(*netpuncher.CReq)
+		if !ok {
+			t.Fatalf("expected CReq, got %+v", msg)
+		}
+		creqs[i] = msg
+	}
+	// Both sides learn the other's public address.
+	if !creqs[0].Addr.IP.Equal(net.IPv4(203, 0, 113, 1)) || !creqs[1].Addr.IP.Equal(net.IPv4(198, 51, 100, 1)) {
+		t.Fatalf("host got %v, client got %v", &creqs[0].Addr, &creqs[1].Addr)
+	}
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- hostl.Punch(&creqs[0].Addr, 2*time.Second, 50*time.Millisecond)
+	}()
+	if err := clientl.Punch(&creqs[1].Addr, 2*time.Second, 50*time.Millisecond); err != nil {
+		t.Fatal("client:", err)
+	}
+	if err := <-errch; err != nil {
+		t.Fatal("host:", err)
+	}
+	conn := simDial(t, clientl, &creqs[1].Addr)
+	peer, err := hostl.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	peer.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if msg, err := peer.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Errorf("ReadMessage() = %q, %v", msg, err)
+	}
+}
+
+// Shutdown notifies connected peers.
+func TestShutdown(t *testing.T) {
+	accepted := make(chan *Conn, 1)
+	s := Server{AcceptConn: func(c *Conn, err error) {
+		if err == nil {
+			accepted <- c
+		}
+	}}
+	raddr := listen(t, &s)
+
+	conn, err := c4netioudp.Dial("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case <-accepted:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for accept")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	readerr := make(chan error)
+	go func() {
+		_, err := conn.Read(nil)
+		readerr <- err
+	}()
+	select {
+	case err := <-readerr:
+		if err != c4netioudp.ErrConnectionClosed("connection closed by peer") {
+			t.Errorf("unexpected read error: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("connection was not closed by the server")
+	}
+
+	// Shutting down again is harmless.
+	if err := s.Close(); err != nil {
+		t.Errorf("Close after Shutdown: %v", err)
+	}
+}
+
+// Hosts get their ID back with the resume token from AssID.
+func TestLeaseResume(t *testing.T) {
+	s := Server{LeaseDuration: 1 * time.Minute}
+	raddr := listen(t, &s)
+	defer s.Close()
+	hdr := netpuncher.Header{Version: 2, Caps: netpuncher.CapResume}
+
+	// Old protocol versions don't get a lease.
+	c0 := dial(t, raddr)
+	assid := requestID(t, c0, netpuncher.Header{Version: 1}, netpuncher.ResumeToken{})
+	if assid.Version != 1 || !assid.ResumeToken.IsZero() {
+		t.Errorf("unexpected AssID for version 1: %+v", assid)
+	}
+
+	c1 := dial(t, raddr)
+	first := requestID(t, c1, hdr, netpuncher.ResumeToken{})
+	if !first.Caps.Has(netpuncher.CapResume) || first.ResumeToken.IsZero() {
+		t.Fatalf("no lease in AssID: %+v", first)
+	}
+	// Repeated requests return the same lease.
+	if again := requestID(t, c1, hdr, netpuncher.ResumeToken{}); !sameLease(again, first) {
+		t.Errorf("repeated IDReq: got %+v, expected %+v", again, first)
+	}
+	c1.Close()
+
+	// Reconnecting after the host disconnected.
+	c2 := dial(t, raddr)
+	resumed := requestID(t, c2, hdr, first.ResumeToken)
+	if !sameLease(resumed, first) {
+		t.Errorf("resume after close: got %+v, expected %+v", resumed, first)
+	}
+
+	// Reconnecting while the old connection is still open.
+	c3 := dial(t, raddr)
+	resumed = requestID(t, c3, hdr, first.ResumeToken)
+	if !sameLease(resumed, first) {
+		t.Errorf("resume while connected: got %+v, expected %+v", resumed, first)
+	}
+
+	// Other hosts get a different ID.
+	c4 := dial(t, raddr)
+	other := requestID(t, c4, hdr, netpuncher.ResumeToken{})
+	if other.CID == first.CID || other.ResumeToken == first.ResumeToken {
+		t.Errorf("second host got the same lease: %+v", other)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	leases := newLeaseTable(1 * time.Minute)
+	now := time.Now()
+	host := &Conn{ID: 1337}
+	l := leases.acquire(host, netpuncher.ResumeToken{}, now)
+	l.conn = host
+	leases.release(l, now)
+
+	if got := leases.acquire(&Conn{ID: 1}, l.token, now.Add(30*time.Second)); got != l {
+		t.Errorf("lease not resumed within grace period")
+	}
+	if got := leases.acquire(&Conn{ID: 2}, l.token, now.Add(2*time.Minute)); got == l || got.id != 2 {
+		t.Errorf("expired lease resumed")
+	}
+	leases.expire(now.Add(2 * time.Minute))
+	if _, ok := leases.leases[l.token]; ok {
+		t.Errorf("expired lease not removed")
+	}
+}
+
+// Hosts with CapAuth only accept clients with a valid join token.
+func TestAuth(t *testing.T) {
+	s := Server{}
+	raddr := listen(t, &s)
+	defer s.Close()
+
+	host := dial(t, raddr)
+	assid := requestID(t, host, netpuncher.Header{Version: 2, Caps: netpuncher.CapAuth}, netpuncher.ResumeToken{})
+	if !assid.Caps.Has(netpuncher.CapAuth) || assid.Secret == (netpuncher.HostSecret{}) {
+		t.Fatalf("no secret in AssID: %+v", assid)
+	}
+
+	client := dial(t, raddr)
+	hdr := netpuncher.Header{Version: 2, Caps: netpuncher.CapAuth}
+	send(t, client, netpuncher.SReq{Header: hdr, CID: assid.CID, Token: netpuncher.NewJoinToken(netpuncher.HostSecret{}, assid.CID)})
+	expected := &netpuncher.NAck{
+		Header:  netpuncher.Header{Type: netpuncher.PID_Puncher_NAck, Version: 2, Caps: netpuncher.CapAuth},
+		Request: netpuncher.PID_Puncher_SReq,
+		CID:     assid.CID,
+		Reason:  netpuncher.NAckAuthFailed,
+	}
+	if msg := receive(t, client); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("invalid token: got %+v, expected %+v", msg, expected)
+	}
+
+	send(t, client, netpuncher.SReq{Header: hdr, CID: assid.CID, Token: netpuncher.NewJoinToken(assid.Secret, assid.CID)})
+	if msg, ok := receive(t, client).(*netpuncher.CReq); !ok {
+		t.Errorf("valid token: expected CReq, got %+v", msg)
+	}
+	if msg, ok := receive(t, host).(*netpuncher.CReq); !ok {
+		t.Errorf("valid token: host expected CReq, got %+v", msg)
+	}
+}
+
+// Failed requests are answered with NAck messages.
+func TestNAck(t *testing.T) {
+	s := Server{}
+	raddr := listen(t, &s)
+	defer s.Close()
+	hdr := netpuncher.Header{Version: 2}
+	nackHdr := netpuncher.Header{Type: netpuncher.PID_Puncher_NAck, Version: 2}
+
+	client := dial(t, raddr)
+	send(t, client, netpuncher.SReqTCP{Header: hdr, CID: 1337})
+	expected := &netpuncher.NAck{Header: nackHdr, Request: netpuncher.PID_Puncher_SReqTCP, CID: 1337, Reason: netpuncher.NAckUnknownHost}
+	if msg := receive(t, client); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("unknown host: got %+v, expected %+v", msg, expected)
+	}
+
+	if _, err := client.Write([]byte{0x7f, 2, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	expected = &netpuncher.NAck{Header: nackHdr, Request: 0x7f, Reason: netpuncher.NAckInvalidMessage}
+	if msg := receive(t, client); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("invalid message: got %+v, expected %+v", msg, expected)
+	}
+
+	// Oversized messages aren't truncated to a valid request.
+	buf, _ := netpuncher.SReq{Header: hdr, CID: 1337}.MarshalBinary()
+	if _, err := client.Write(append(buf, make([]byte, netpuncher.MaxPacketSize)...)); err != nil {
+		t.Fatal(err)
+	}
+	expected = &netpuncher.NAck{Header: nackHdr, Reason: netpuncher.NAckInvalidMessage}
+	if msg := receive(t, client); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("oversized message: got %+v, expected %+v", msg, expected)
+	}
+
+	if _, err := client.Write([]byte{netpuncher.PID_Puncher_SReq, 0xff, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	expected = &netpuncher.NAck{Header: nackHdr, Reason: netpuncher.NAckUnsupportedVersion}
+	if msg := receive(t, client); !reflect.DeepEqual(msg, expected) {
+		t.Errorf("unsupported version: got %+v, expected %+v", msg, expected)
+	}
+}
+
+// A host renegotiating its header while the server builds CReq messages for
+// it doesn't race (run with -race).
+func TestRenegotiateDuringCReq(t *testing.T) {
+	s := Server{LeaseDuration: 1 * time.Minute}
+	raddr := listen(t, &s)
+	defer s.Close()
+	host := dial(t, raddr)
+	client := dial(t, raddr)
+	assid := requestID(t, host, netpuncher.Header{Version: 2}, netpuncher.ResumeToken{})
+
+	// Nobody reads the AssID and CReq messages for the host otherwise.
+	go func() {
+		for {
+			if _, err := host.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	const n = 50
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			caps := netpuncher.Capabilities(0)
+			if i%2 == 1 {
+				caps = netpuncher.CapResume
+			}
+			buf, _ := netpuncher.IDReq{Header: netpuncher.Header{Version: 2, Caps: caps}}.MarshalBinary()
+			host.Write(buf)
+		}
+	}()
+	for i := 0; i < n; i++ {
+		send(t, client, netpuncher.SReq{Header: netpuncher.Header{Version: 2}, CID: assid.CID})
+		if msg, ok := receive(t, client).(*netpuncher.CReq); !ok {
+			t.Fatalf("expected CReq, got %+v", msg)
+		}
+	}
+	<-done
+}